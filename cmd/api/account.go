@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// 导出当前用户的所有数据 以JSON附件的形式返回
+func (app *application) exportUserDataHandler(c *gin.Context) {
+	userID := app.contextGetUser(c).ID
+	user, err := app.models.User.Get(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 导出用户本身拥有的权限 不受当前请求权限范围的限制
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	permissionChanges, err := app.models.Permissions.GetChangesForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	sessions, err := app.models.Token.GetSessionsForUser(userID, app.contextGetTokenHash(c))
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	apiKeys, err := app.models.APIKeys.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	identities, err := app.models.Identities.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	reviews, err := app.models.Reviews.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	watchlist, err := app.models.Watch.GetAllWatchlist(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	history, err := app.models.Watch.GetAllHistory(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	lists, err := app.models.Lists.GetAllWithItems(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	userTOTP, err := app.models.MFA.GetTOTP(userID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	export := envelop{
+		"exported_at":        time.Now(),
+		"user":               user,
+		"permissions":        permissions,
+		"permission_changes": permissionChanges,
+		"roles":              roles,
+		"sessions":           sessions,
+		"api_keys":           apiKeys,
+		"identities":         identities,
+		"reviews":            reviews,
+		"watchlist":          watchlist,
+		"watch_history":      history,
+		"lists":              lists,
+		"two_factor":         envelop{"totp_enabled": userTOTP != nil && userTOTP.Confirmed},
+	}
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cinelight-export-%d.json"`, userID))
+	app.writeJson(c, http.StatusOK, envelop{"export": export}, headers)
+}
+
+// 申请删除当前用户的账号 在宽限期结束后由后台任务完成删除
+func (app *application) deleteCurrentUserHandler(c *gin.Context) {
+	var input struct {
+		Password string `json:"password"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user, err := app.models.User.Get(app.contextGetUser(c).ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 删除账号前需要再次确认密码
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	if user.DeletionScheduledAt != nil {
+		v.AddError("account", "deletion has already been scheduled")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.User.ScheduleDeletion(user, time.Now().Add(app.config.account.deletionGracePeriod))
+		if err != nil {
+			return err
+		}
+		// 撤销所有的会话与API秘钥 用户在宽限期内仍然可以重新登录以取消删除
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+			err = tx.Token.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.APIKeys.DeleteAllForUser(user.ID)
+		if err != nil {
+			return err
+		}
+		emailData := map[string]interface{}{
+			"deletionScheduledAt": user.DeletionScheduledAt.UTC().Format(time.RFC1123),
+		}
+		return app.queueEmail(tx.Outbox, user.Email, "account_deletion_scheduled.tmpl.html", emailData)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.syncDenylist()
+	env := envelop{
+		"message":               "your account has been scheduled for deletion",
+		"deletion_scheduled_at": user.DeletionScheduledAt,
+	}
+	app.writeJson(c, http.StatusAccepted, env, nil)
+}
+
+// 在宽限期内取消账号的删除
+func (app *application) cancelUserDeletionHandler(c *gin.Context) {
+	err := app.models.User.CancelDeletion(app.contextGetUser(c).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "account deletion successfully cancelled"}, nil)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// 为当前用户创建新的API秘钥 秘钥的权限必须是用户所拥有权限的子集
+func (app *application) createAPIKeyHandler(c *gin.Context) {
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	key := &data.APIKey{
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+	v := validator.New()
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user := app.contextGetUser(c)
+	// 查询用户当前拥有的权限
+	permissions, err := app.contextGetPermissions(c)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 若当前请求本身受到限制(使用API秘钥创建) 新秘钥的权限同样不能超出该范围
+	limit, limited := app.contextGetPermissionLimit(c)
+	for _, code := range key.Permissions {
+		if !permissions.Include(code) || (limited && !limit.Include(code)) {
+			v.AddError("permissions", fmt.Sprintf("permission %q is not granted to your account", code))
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	key, err = app.models.APIKeys.New(user.ID, key.Name, key.Permissions, key.Expiry)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 秘钥的明文只会在这里返回一次
+	app.writeJson(c, http.StatusCreated, envelop{"api_key": key}, nil)
+}
+
+// 列出当前用户的所有API秘钥
+func (app *application) listAPIKeysHandler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"api_keys": keys}, nil)
+}
+
+// 删除当前用户的某个API秘钥
+func (app *application) deleteAPIKeyHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	user := app.contextGetUser(c)
+	err = app.models.APIKeys.Delete(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "api key successfully deleted"}, nil)
+}
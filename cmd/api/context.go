@@ -10,6 +10,15 @@ import (
 // 将user(string) -> user(contextKey)避免冲突的同时方便后续进行类型断言
 const userContextKey = "user"
 
+// 存储当前请求使用的认证Token的哈希 用于登出与标记当前会话
+const tokenContextKey = "token_hash"
+
+// 存储当前请求被限制在的权限范围(例如API秘钥被授予的权限)
+const permissionLimitContextKey = "permission_limit"
+
+// 存储当前用户拥有的权限 保证每个请求最多只查询一次
+const permissionsContextKey = "permissions"
+
 // 返回包含新的context的*http.request(将提供的user结构体嵌入请求体的context)
 func (app *application) contextSetUser(c *gin.Context, user *data.User) {
 	// 提取当前请求的context创建的新的context
@@ -40,3 +49,56 @@ func (app *application) contextGetUser(c *gin.Context) *data.User {
 	}
 	return user
 }
+
+// 将当前请求使用的认证Token的哈希存入context
+func (app *application) contextSetTokenHash(c *gin.Context, hash []byte) {
+	c.Set(tokenContextKey, hash)
+}
+
+// 从context中提取当前请求使用的认证Token的哈希 若请求没有携带Token则返回nil
+func (app *application) contextGetTokenHash(c *gin.Context) []byte {
+	val, ok := c.Get(tokenContextKey)
+	if !ok {
+		return nil
+	}
+	hash, ok := val.([]byte)
+	if !ok {
+		panic("wrong token hash type")
+	}
+	return hash
+}
+
+// 将当前请求限制在给定的权限范围内 即使用户本身拥有更多的权限
+func (app *application) contextSetPermissionLimit(c *gin.Context, permissions data.Permissions) {
+	c.Set(permissionLimitContextKey, permissions)
+}
+
+// 从context中提取当前请求的权限范围 第二个返回值表示请求是否受到限制
+func (app *application) contextGetPermissionLimit(c *gin.Context) (data.Permissions, bool) {
+	val, ok := c.Get(permissionLimitContextKey)
+	if !ok {
+		return nil, false
+	}
+	permissions, ok := val.(data.Permissions)
+	if !ok {
+		panic("wrong permission limit type")
+	}
+	return permissions, true
+}
+
+// 获取当前用户拥有的权限 同一个请求中只会在第一次调用时查询 之后直接从context中读取
+func (app *application) contextGetPermissions(c *gin.Context) (data.Permissions, error) {
+	if val, ok := c.Get(permissionsContextKey); ok {
+		permissions, ok := val.(data.Permissions)
+		if !ok {
+			panic("wrong permissions type")
+		}
+		return permissions, nil
+	}
+	permissions, err := app.userPermissions(app.contextGetUser(c).ID)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(permissionsContextKey, permissions)
+	return permissions, nil
+}
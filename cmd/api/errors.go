@@ -2,7 +2,10 @@ package main
 
 import (
 	"github.com/gin-gonic/gin"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // 生成错误日志
@@ -80,6 +83,28 @@ func (app *application) invalidCredentialResponse(c *gin.Context) {
 	app.errorResponse(c, http.StatusUnauthorized, msg)
 }
 
+// 返回账号或IP因多次登录失败被暂时锁定
+func (app *application) accountLockedResponse(c *gin.Context, lockedUntil time.Time) {
+	// 告诉客户端需要等待多久才能重试
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(lockedUntil).Seconds()))))
+	msg := "too many failed login attempts, please try again later"
+	app.errorResponse(c, http.StatusLocked, msg)
+}
+
+// 按照RFC 6749的格式返回OAuth2错误 第三方应用的客户端库依赖这种格式
+func (app *application) oauthErrorResponse(c *gin.Context, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// 返回当前只允许通过邀请注册
+func (app *application) registrationClosedResponse(c *gin.Context) {
+	msg := "registration requires an invitation"
+	app.errorResponse(c, http.StatusForbidden, msg)
+}
+
 // 返回表头存储的秘钥无效
 func (app *application) invalidAuthenticationTokenResponse(c *gin.Context) {
 	// 告诉客户端应该使用未加密的Token进行认证
@@ -88,6 +113,12 @@ func (app *application) invalidAuthenticationTokenResponse(c *gin.Context) {
 	app.errorResponse(c, http.StatusUnauthorized, msg)
 }
 
+// 返回刷新Token无效
+func (app *application) invalidRefreshTokenResponse(c *gin.Context) {
+	msg := "invalid or expired refresh token"
+	app.errorResponse(c, http.StatusUnauthorized, msg)
+}
+
 // 返回认证(登录账号)无效
 func (app *application) authenticationRequireResponse(c *gin.Context) {
 	msg := "you must be authenticated to access this resource"
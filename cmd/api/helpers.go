@@ -137,25 +137,16 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// 用于公式化启动后台goroutine
-func (app *application) background(fn func()) {
-	// 使用WaitGroup同步所有的goroutine
-	// 当前需要检测的活跃协程 +1
-	app.wg.Add(1)
-	// 启动函数goroutine
-	go func() {
-		// 完成任务后进行 -1
-		defer app.wg.Done()
-		// 捕获后台goroutine的panic
-		defer func() {
-			// 恢复panic
-			if err := recover(); err != nil {
-				// 使用app.logger.PrintError输出错误信息而不是errResponse重复写入响应体
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
-			}
-		}()
-		// 执行函数的逻辑
-		// 在go中func可以被赋值给变量也可以作为参数直接传递
-		fn()
-	}()
+// 从query string中读取布尔值 无法转换时记录下错误返回默认值
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
 }
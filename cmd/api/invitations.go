@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 注册模式
+const (
+	registrationOpen   = "open"   // 任何人都可以注册
+	registrationInvite = "invite" // 只有持有邀请码的人可以注册
+)
+
+// 邀请的有效期
+const invitationTTL = 7 * 24 * time.Hour
+
+// 创建新的注册邀请并通过邮件发送给被邀请者
+func (app *application) createInvitationHandler(c *gin.Context) {
+	var input struct {
+		Email       string   `json:"email"`
+		Role        *string  `json:"role"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	actor := app.contextGetUser(c)
+	invitation := &data.Invitation{
+		Email:       input.Email,
+		InvitedBy:   &actor.ID,
+		Role:        input.Role,
+		Permissions: input.Permissions,
+	}
+	v := validator.New()
+	data.ValidateInvitation(v, invitation)
+	err = app.checkPermissionCodes(v, invitation.Permissions)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 检查角色是否存在
+	if invitation.Role != nil {
+		roles, err := app.models.Roles.GetAll()
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		names := make([]string, len(roles))
+		for i := range roles {
+			names[i] = roles[i].Name
+		}
+		v.Check(validator.In(*invitation.Role, names...), "role", fmt.Sprintf("unknown role %q", *invitation.Role))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 已经注册的邮箱不需要邀请
+	_, err = app.models.User.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email already exists")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Transaction(func(tx data.Models) error {
+		err := tx.Invitations.New(invitation, invitationTTL)
+		if err != nil {
+			return err
+		}
+		emailData := map[string]interface{}{
+			"invitation": invitation.Plaintext,
+			"email":      invitation.Email,
+		}
+		return app.queueEmail(tx.Outbox, invitation.Email, "user_invitation.tmpl.html", emailData)
+	})
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/invitations/%d", invitation.ID))
+	app.writeJson(c, http.StatusCreated, envelop{"invitation": invitation}, headers)
+}
+
+// 列出所有尚未被接受的邀请
+func (app *application) listInvitationsHandler(c *gin.Context) {
+	invitations, err := app.models.Invitations.GetAllPending()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"invitations": invitations}, nil)
+}
+
+// 撤销尚未被接受的邀请
+func (app *application) deleteInvitationHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Invitations.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "invitation successfully deleted"}, nil)
+}
+
+// 检查注册时提供的邀请码 邀请必须发给注册使用的邮箱
+// 失败时已经写入了响应体
+func (app *application) readInvitation(c *gin.Context, plaintext, email string) (*data.Invitation, bool) {
+	v := validator.New()
+	if data.ValidateInvitationPlaintext(v, plaintext); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, false
+	}
+	invitation, err := app.models.Invitations.GetForPlaintext(plaintext)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return nil, false
+	}
+	if invitation == nil || !strings.EqualFold(invitation.Email, email) {
+		v.AddError("invitation", "invalid or expired invitation")
+		app.failedValidationResponse(c, v.Errors)
+		return nil, false
+	}
+	return invitation, true
+}
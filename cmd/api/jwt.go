@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/jwt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内存中的Token撤销列表 使用JWT时认证中间件只检查内存而不查询数据库
+type tokenDenylist struct {
+	mu       sync.RWMutex
+	denylist data.Denylist
+}
+
+// 检查Token的哈希是否在撤销列表中
+func (d *tokenDenylist) include(hash []byte) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.denylist.Include(hash)
+}
+
+// 使用从数据库读取到的撤销列表替换当前的列表
+func (d *tokenDenylist) set(denylist data.Denylist) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.denylist = denylist
+}
+
+// 根据配置载入用于签发与验证JWT的秘钥集合
+func loadJWTKeys(cfg config) (*jwt.KeySet, error) {
+	var keys []*jwt.Key
+	for _, spec := range cfg.jwt.keys {
+		// 格式为 kid:alg:path 路径中可能包含":" 所以最多分割成三份
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid jwt key %q, expected kid:alg:path", spec)
+		}
+		key, err := jwt.LoadKey(parts[0], parts[1], parts[2])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return jwt.NewKeySet(cfg.jwt.signingKID, keys...)
+}
+
+// 在JWT模式下将认证Token签发为JWT
+// jti使用数据库中存储的哈希(十六进制) 用于撤销与会话管理
+// JWT的内容只是经过编码而没有加密 不能放入Token的明文 否则任何看到JWT的人都能得到另一个有效的认证Token
+func (app *application) signAuthenticationToken(user *data.User, token *data.Token) error {
+	if app.jwtKeys == nil {
+		return nil
+	}
+	signed, err := app.jwtKeys.Sign(jwt.Claims{
+		Subject:   user.ID,
+		ID:        hex.EncodeToString(token.Hash),
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: token.Expiry.Unix(),
+		Name:      user.Name,
+		Email:     user.Email,
+		Activated: user.Activated,
+	})
+	if err != nil {
+		return err
+	}
+	token.Plaintext = signed
+	return nil
+}
+
+// 验证JWT并根据其中的声明还原用户信息 返回用户与jti对应的Token哈希
+func (app *application) userFromJWT(token string) (*data.User, []byte, error) {
+	claims, err := app.jwtKeys.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, err := hex.DecodeString(claims.ID)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	// 只有出现在撤销列表中的Token才会被拒绝
+	if app.denylist.include(hash) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	user := &data.User{
+		ID:        claims.Subject,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Activated: claims.Activated,
+	}
+	return user, hash, nil
+}
+
+// 从数据库同步撤销列表 在撤销Token后调用使本实例立即生效
+func (app *application) syncDenylist() {
+	if app.jwtKeys == nil {
+		return
+	}
+	denylist, err := app.models.Denylist.GetAll()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.denylist.set(denylist)
+}
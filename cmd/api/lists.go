@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"strconv"
+)
+
+// 列出公开的片单 不需要登录 支持按名称搜索、分页与排序
+func (app *application) listPublicListsHandler(c *gin.Context) {
+	var input struct {
+		Name string
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// 默认最近更新的在前
+	input.Filters.Sort = app.readString(qs, "sort", "-updated_at")
+	input.SortSafeList = []string{"name", "created_at", "updated_at", "-name", "-created_at", "-updated_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	lists, metaData, err := app.models.Lists.GetAllPublic(input.Name, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"lists": lists, "metadata": metaData}, nil)
+}
+
+// 通过分享链接查看片单与其中的电影 不需要登录
+// 私有的片单只有创建者自己可以通过链接查看 对其他人表现为不存在
+func (app *application) showSharedListHandler(c *gin.Context) {
+	list, err := app.models.Lists.GetBySlug(c.Param("slug"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	if list.Visibility == data.ListPrivate {
+		user := app.contextGetUser(c)
+		if user.IsAnonymous() || user.ID != list.UserID {
+			app.notFoundResponse(c)
+			return
+		}
+	}
+	list.Items, err = app.models.Lists.GetItems(list.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"list": list}, nil)
+}
+
+// 读取路由中的片单ID并查询当前用户的片单 失败时已经发送了响应
+func (app *application) readListParam(c *gin.Context) (*data.List, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return nil, false
+	}
+	list, err := app.models.Lists.GetForUser(id, app.contextGetUser(c).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return list, true
+}
+
+// 列出当前用户的所有片单 包括私有的片单
+func (app *application) listUserListsHandler(c *gin.Context) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-updated_at")
+	input.SortSafeList = []string{"name", "created_at", "updated_at", "-name", "-created_at", "-updated_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	lists, metaData, err := app.models.Lists.GetAllForUser(app.contextGetUser(c).ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"lists": lists, "metadata": metaData}, nil)
+}
+
+// 创建新的片单 未指定可见性时默认为私有
+func (app *application) createListHandler(c *gin.Context) {
+	var input struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	user := app.contextGetUser(c)
+	list := &data.List{
+		UserID:      user.ID,
+		OwnerName:   user.Name,
+		Name:        input.Name,
+		Description: input.Description,
+		Visibility:  input.Visibility,
+	}
+	if list.Visibility == "" {
+		list.Visibility = data.ListPrivate
+	}
+	v := validator.New()
+	if data.ValidateList(v, list); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Lists.Insert(list)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/lists/%s", list.Slug))
+	app.writeJson(c, http.StatusCreated, envelop{"list": list}, headers)
+}
+
+// 查看当前用户的片单与其中的电影
+func (app *application) showUserListHandler(c *gin.Context) {
+	list, ok := app.readListParam(c)
+	if !ok {
+		return
+	}
+	var err error
+	list.Items, err = app.models.Lists.GetItems(list.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"list": list}, nil)
+}
+
+// 修改片单的信息 只更新请求中提供的字段
+func (app *application) updateListHandler(c *gin.Context) {
+	list, ok := app.readListParam(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Visibility  *string `json:"visibility"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	if input.Name != nil {
+		list.Name = *input.Name
+	}
+	if input.Description != nil {
+		list.Description = *input.Description
+	}
+	if input.Visibility != nil {
+		list.Visibility = *input.Visibility
+	}
+	v := validator.New()
+	if data.ValidateList(v, list); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Lists.Update(list)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"list": list}, nil)
+}
+
+// 重新生成片单的分享链接 旧的链接随即失效
+func (app *application) regenerateListSlugHandler(c *gin.Context) {
+	list, ok := app.readListParam(c)
+	if !ok {
+		return
+	}
+	err := app.models.Lists.RegenerateSlug(list)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"list": list}, nil)
+}
+
+// 删除当前用户的片单
+func (app *application) deleteListHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Lists.Delete(id, app.contextGetUser(c).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "list successfully deleted"}, nil)
+}
+
+// 将电影加入片单 未指定位置时加入到末尾
+func (app *application) addListItemHandler(c *gin.Context) {
+	listID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	var input struct {
+		MovieID  int64 `json:"movie_id"`
+		Position int32 `json:"position"`
+	}
+	err = app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.MovieID > 0, "movie_id", "must be provided")
+	v.Check(input.Position >= 0, "position", "must not be negative")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	item, err := app.models.Lists.AddItem(listID, app.contextGetUser(c).ID, input.MovieID, input.Position)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		case errors.Is(err, data.ErrUnknownMovie):
+			v.AddError("movie_id", "does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		case errors.Is(err, data.ErrDuplicateListItem):
+			v.AddError("movie_id", "is already in this list")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	env := envelop{"item": envelop{"movie_id": input.MovieID, "position": item.Position, "added_at": item.AddedAt}}
+	app.writeJson(c, http.StatusCreated, env, nil)
+}
+
+// 一次性提交片单中所有电影的新顺序 整个调整在同一个事务中完成
+func (app *application) reorderListItemsHandler(c *gin.Context) {
+	listID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	var input struct {
+		MovieIDs []int64 `json:"movie_ids"`
+	}
+	err = app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.MovieIDs != nil, "movie_ids", "must be provided")
+	seen := make(map[int64]bool, len(input.MovieIDs))
+	for _, id := range input.MovieIDs {
+		v.Check(!seen[id], "movie_ids", "must not contain duplicate values")
+		seen[id] = true
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	userID := app.contextGetUser(c).ID
+	err = app.models.Lists.Reorder(listID, userID, input.MovieIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		case errors.Is(err, data.ErrListItemsMismatch):
+			v.AddError("movie_ids", "must contain exactly the movies in this list")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	items, err := app.models.Lists.GetItems(listID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"items": items}, nil)
+}
+
+// 将电影从片单中移除
+func (app *application) removeListItemHandler(c *gin.Context) {
+	listID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	movieID, err := strconv.ParseInt(c.Param("movie_id"), 10, 64)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Lists.RemoveItem(listID, app.contextGetUser(c).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "movie successfully removed from list"}, nil)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"net/http"
+	"time"
+)
+
+// 检查登录请求的账号或IP是否被锁定 被锁定时已经写入了响应体并返回true
+func (app *application) loginLocked(c *gin.Context, email, ip string) bool {
+	for _, check := range []struct{ kind, subject string }{
+		{data.LockoutIP, ip},
+		{data.LockoutAccount, email},
+	} {
+		lockedUntil, err := app.models.Lockout.LockedUntil(check.kind, check.subject)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return true
+		}
+		if !lockedUntil.IsZero() {
+			app.accountLockedResponse(c, lockedUntil)
+			return true
+		}
+	}
+	return false
+}
+
+// 记录一次失败的登录 账号因此被锁定时通知账号的拥有者
+// 邮箱不存在时user为nil 仍然按邮箱计数 避免通过响应区分账号是否存在
+func (app *application) recordLoginFailure(email, ip string, user *data.User) error {
+	_, err := app.models.Lockout.RecordFailure(data.LockoutIP, ip, app.config.ipLockoutPolicy())
+	if err != nil {
+		return err
+	}
+	lockedUntil, err := app.models.Lockout.RecordFailure(data.LockoutAccount, email, app.config.accountLockoutPolicy())
+	if err != nil {
+		return err
+	}
+	if lockedUntil.IsZero() || user == nil {
+		return nil
+	}
+	app.logger.PrintInfo("account locked after repeated failed logins", map[string]string{
+		"email": user.Email,
+		"ip":    ip,
+	})
+	emailData := map[string]interface{}{
+		"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+		"ip":          ip,
+	}
+	return app.queueEmail(app.models.Outbox, user.Email, "account_locked.tmpl.html", emailData)
+}
+
+// 管理员解除账号的锁定
+func (app *application) unlockUserHandler(c *gin.Context) {
+	user, ok := app.readUserParam(c)
+	if !ok {
+		return
+	}
+	err := app.models.Lockout.Reset(data.LockoutAccount, user.Email)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "account successfully unlocked"}, nil)
+}
+
+// 按账号统计登录失败的锁定策略
+func (cfg config) accountLockoutPolicy() data.LockoutPolicy {
+	return data.LockoutPolicy{
+		Threshold:   cfg.lockout.threshold,
+		Window:      cfg.lockout.window,
+		Duration:    cfg.lockout.duration,
+		MaxDuration: cfg.lockout.maxDuration,
+	}
+}
+
+// 按IP统计登录失败的锁定策略 除阈值外与账号相同
+func (cfg config) ipLockoutPolicy() data.LockoutPolicy {
+	policy := cfg.accountLockoutPolicy()
+	policy.Threshold = cfg.lockout.ipThreshold
+	return policy
+}
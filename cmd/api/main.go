@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"greenlight.vdebu.net/internal/auth"
 	"greenlight.vdebu.net/internal/data"
 	"greenlight.vdebu.net/internal/jsonlog"
+	"greenlight.vdebu.net/internal/jwt"
 	"greenlight.vdebu.net/internal/mailer"
 	"os"
 	"runtime"
@@ -41,6 +44,10 @@ type config struct {
 		burst  int     // 默认令牌值
 		enable bool    // 是否开启速率限制
 	}
+	mailer struct {
+		backend string // 邮件的发送方式 smtp|file|log|memory
+		dir     string // file方式写入.eml文件的目录
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -48,9 +55,46 @@ type config struct {
 		password string // 用于发送邮箱的账号
 		sender   string // 发件人
 	}
+	outbox struct {
+		workers     int // 同时发送邮件的goroutine数量
+		maxAttempts int // 超过这个次数后放弃发送 需要管理员重新加入队列
+	}
 	cors struct {
 		trustedOrigins []string // 受信的跨院網站
 	}
+	auth struct {
+		accessTokenTTL  time.Duration // 认证Token的有效期
+		refreshTokenTTL time.Duration // 刷新Token的有效期 每次使用后都会被轮换
+	}
+	registration struct {
+		mode string // 注册模式 open|invite
+	}
+	account struct {
+		deletionGracePeriod time.Duration // 申请删除账号后可以取消的时间
+	}
+	cleanup struct {
+		interval        time.Duration // 后台清理任务的执行间隔
+		unactivatedDays int           // 注册后超过这些天仍未激活的账号会被删除 为0时不删除
+		movieTrashDays  int           // 删除的电影保留这些天后彻底删除 为0时一直保留
+	}
+	lockout struct {
+		threshold   int           // 同一账号连续登录失败多少次后锁定
+		ipThreshold int           // 同一IP连续登录失败多少次后锁定
+		window      time.Duration // 超过这个时间没有再失败则重新计数
+		duration    time.Duration // 第一次锁定的时长 之后每次翻倍
+		maxDuration time.Duration // 锁定时长的上限
+	}
+	permissions struct {
+		cacheTTL time.Duration // 进程内权限缓存的有效期 为0时不启用缓存
+	}
+	oidc struct {
+		providers []string // 外部身份提供方 逗号分隔的key=value
+	}
+	jwt struct {
+		enabled    bool     // 是否将认证Token签发为JWT
+		signingKID string   // 用于签发新Token的秘钥ID
+		keys       []string // 所有可用于验证的秘钥 kid:alg:path
+	}
 }
 
 // 注入依赖
@@ -58,8 +102,19 @@ type application struct {
 	config config          // 服务器默认配置
 	logger *jsonlog.Logger // JSON形式的logger
 	models data.Models     // 数据库中的数据模型
-	mailer mailer.Mailer   // 邮箱服务
+	mailer mailer.Sender   // 邮箱服务
 	wg     sync.WaitGroup  // 同步goroutine工作进度 默认0值后续无需进行初始化
+	// 服务器开始关闭时被关闭 通知长期运行的后台任务退出
+	shutdown chan struct{}
+	// 启用JWT时用于签发与验证的秘钥集合 未启用时为nil
+	jwtKeys  *jwt.KeySet
+	denylist tokenDenylist // 内存中的Token撤销列表
+	// 可用于登录的外部身份提供方 名称 -> 提供方
+	authProviders map[string]*auth.Provider
+	// 进程内的用户权限缓存 未启用时为nil
+	permissionCache *permissionCache
+	// 返回当前时间 测试时可以替换为固定的时钟
+	now func() time.Time
 }
 
 func main() {
@@ -87,18 +142,57 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enable, "limiter-enabled", true, "Enable rate limiter")
-	// 邮箱服务器的配置
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	// 邮件的发送方式 默认只输出到日志 不需要SMTP服务器
+	// 默认通过SMTP发送 未配置SMTP服务器时启动失败 避免生产环境中的邮件被悄悄丢弃
+	flag.StringVar(&cfg.mailer.backend, "mailer", "smtp", "Mailer backend (smtp|file|log|memory)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Directory for .eml files written by the file mailer")
+	// 邮箱服务器的配置 使用smtp方式时需要提供
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "6d1f560db0b87a", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "ca65fbfdf5d908", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@Greenlight.vdebu.net>", "SMTP sender")
+	// 发件箱的配置
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of email outbox workers")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Delivery attempts before an email is marked dead")
 	// 受信的跨源請求
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
 		// 將輸入的字符串
 		cfg.cors.trustedOrigins = strings.Fields(s)
 		return nil
 	})
+	// 认证Token与刷新Token的有效期
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Authentication token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	// 注册模式 内部部署时只允许持有邀请码的人注册
+	flag.StringVar(&cfg.registration.mode, "registration-mode", registrationOpen, "Registration mode (open|invite)")
+	// 删除账号的宽限期
+	flag.DurationVar(&cfg.account.deletionGracePeriod, "account-deletion-grace-period", 14*24*time.Hour, "Grace period before a deleted account is removed")
+	// 后台清理任务的配置
+	flag.DurationVar(&cfg.cleanup.interval, "cleanup-interval", time.Hour, "Interval between background cleanup runs")
+	flag.IntVar(&cfg.cleanup.unactivatedDays, "cleanup-unactivated-days", 30, "Delete accounts not activated within this many days (0 disables)")
+	flag.IntVar(&cfg.cleanup.movieTrashDays, "cleanup-movie-trash-days", 30, "Permanently remove deleted movies after this many days (0 disables)")
+	// 登录失败锁定的配置
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Failed logins per account before locking (0 disables)")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 50, "Failed logins per IP before locking (0 disables)")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", 15*time.Minute, "Window in which failed logins are counted")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", time.Minute, "Initial lock duration, doubled on every subsequent lock")
+	flag.DurationVar(&cfg.lockout.maxDuration, "lockout-max-duration", time.Hour, "Maximum lock duration")
+	// 用户权限缓存的有效期
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", 0, "In-process permission cache TTL (0 disables the cache)")
+	// JWT认证模式的配置
+	flag.BoolVar(&cfg.jwt.enabled, "jwt-enabled", false, "Issue signed JWTs as authentication tokens")
+	flag.StringVar(&cfg.jwt.signingKID, "jwt-signing-kid", "", "ID of the JWT key used for signing")
+	// 可以重复指定多个秘钥用于秘钥轮换
+	flag.Func("jwt-key", "JWT key as kid:alg:path, alg is HS256 or EdDSA (repeatable)", func(s string) error {
+		cfg.jwt.keys = append(cfg.jwt.keys, s)
+		return nil
+	})
+	// 外部身份提供方(OIDC)的配置
+	flag.Func("oidc-provider", "OIDC provider as name=...,issuer=...,client-id=...,client-secret=...,redirect-url=...[,scopes=...] (repeatable)", func(s string) error {
+		cfg.oidc.providers = append(cfg.oidc.providers, s)
+		return nil
+	})
 	// 判断当前是否仅展示版本信息
 	// 这里只要在参数中提到了-Version(不进行赋值)默认就是true
 	displayVersion := flag.Bool("version", false, "Display version and exit")
@@ -115,6 +209,27 @@ func main() {
 	}
 	// 初始化服务器内部的日志工具
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// 检查注册模式是否有效
+	if cfg.registration.mode != registrationOpen && cfg.registration.mode != registrationInvite {
+		logger.PrintFatal(fmt.Errorf("invalid registration mode %q", cfg.registration.mode), nil)
+	}
+	// 检查后台清理任务的配置
+	if cfg.cleanup.interval <= 0 || cfg.cleanup.unactivatedDays < 0 || cfg.cleanup.movieTrashDays < 0 {
+		logger.PrintFatal(fmt.Errorf("invalid cleanup configuration"), nil)
+	}
+	// 检查发件箱的配置
+	if cfg.outbox.workers < 1 || cfg.outbox.maxAttempts < 1 {
+		logger.PrintFatal(fmt.Errorf("invalid outbox configuration"), nil)
+	}
+	// 失败记录在保留时间之后会被清理 统计窗口不能超过保留时间
+	if cfg.lockout.window >= data.LockoutRetention {
+		logger.PrintFatal(fmt.Errorf("lockout window must be shorter than %s", data.LockoutRetention), nil)
+	}
+	// 初始化邮件系统 在连接数据库之前检查 配置有误时尽早退出
+	sender, err := newMailer(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	//logger.Println("dsn:", cfg.db.dsn)
 	// 初始化数据库链接
 	logger.PrintInfo(fmt.Sprintf("'DSN':'%s'", cfg.db.dsn), nil)
@@ -146,17 +261,38 @@ func main() {
 	}))
 	// 初始化依赖
 	app := &application{
-		config: cfg,    // 载入服务器配置
-		logger: logger, // 初始化默认标准输出，信息为Info的Logger
-		models: models, // 嵌入数据模型
-		mailer: mailer.New( // 初始化邮件系统
-			cfg.smtp.host,
-			cfg.smtp.port,
-			cfg.smtp.username,
-			cfg.smtp.password,
-			cfg.smtp.sender,
-		),
+		config:   cfg,                 // 载入服务器配置
+		logger:   logger,              // 初始化默认标准输出，信息为Info的Logger
+		models:   models,              // 嵌入数据模型
+		mailer:   sender,              // 邮件的发送方式
+		shutdown: make(chan struct{}), // 通知后台任务退出
+		now:      time.Now,            // 使用系统时钟
 	}
+	// 载入外部身份提供方
+	app.authProviders = make(map[string]*auth.Provider)
+	for _, spec := range cfg.oidc.providers {
+		provider, err := parseOIDCProvider(spec)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		app.authProviders[provider.Name()] = provider
+	}
+	// 启用权限缓存
+	if cfg.permissions.cacheTTL > 0 {
+		app.permissionCache = newPermissionCache(cfg.permissions.cacheTTL)
+	}
+	// 启用JWT时载入秘钥并同步Token撤销列表
+	if cfg.jwt.enabled {
+		app.jwtKeys, err = loadJWTKeys(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		app.syncDenylist()
+	}
+	// 启动清理过期数据等后台任务
+	app.startScheduler(app.backgroundJobs())
+	// 启动发件箱的发送者
+	app.startOutboxWorkers(cfg.outbox.workers)
 	// 初始化服务器信息
 	err = app.server()
 	if err != nil {
@@ -164,6 +300,25 @@ func main() {
 	}
 }
 
+// 根据配置创建邮件的发送者
+func newMailer(cfg config, logger *jsonlog.Logger) (mailer.Sender, error) {
+	switch cfg.mailer.backend {
+	case "smtp":
+		if cfg.smtp.host == "" {
+			return nil, errors.New("smtp mailer requires -smtp-host")
+		}
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender), nil
+	case "file":
+		return mailer.NewFile(cfg.mailer.dir, cfg.smtp.sender)
+	case "log":
+		return mailer.NewLog(logger), nil
+	case "memory":
+		return mailer.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("invalid mailer backend %q", cfg.mailer.backend)
+	}
+}
+
 // 尝试连接数据库 返回数据库连接池sql.DB
 func openDB(cfg config) (*sql.DB, error) {
 
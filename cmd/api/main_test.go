@@ -0,0 +1,47 @@
+package main
+
+import (
+	"greenlight.vdebu.net/internal/jsonlog"
+	"greenlight.vdebu.net/internal/mailer"
+	"io"
+	"testing"
+)
+
+func TestNewMailerRequiresSMTPHost(t *testing.T) {
+	var cfg config
+	cfg.mailer.backend = "smtp"
+	_, err := newMailer(cfg, jsonlog.New(io.Discard, jsonlog.LevelInfo))
+	if err == nil {
+		t.Fatal("expected an error when -smtp-host is missing")
+	}
+
+	cfg.smtp.host = "smtp.example.com"
+	sender, err := newMailer(cfg, jsonlog.New(io.Discard, jsonlog.LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sender.(*mailer.SMTP); !ok {
+		t.Errorf("got %T; want *mailer.SMTP", sender)
+	}
+}
+
+func TestNewMailerMemory(t *testing.T) {
+	var cfg config
+	cfg.mailer.backend = "memory"
+	sender, err := newMailer(cfg, jsonlog.New(io.Discard, jsonlog.LevelInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sender.(*mailer.Memory); !ok {
+		t.Errorf("got %T; want *mailer.Memory", sender)
+	}
+}
+
+func TestNewMailerRejectsUnknownBackend(t *testing.T) {
+	var cfg config
+	cfg.mailer.backend = "carrier-pigeon"
+	_, err := newMailer(cfg, jsonlog.New(io.Discard, jsonlog.LevelInfo))
+	if err == nil {
+		t.Fatal("expected an error for an unknown backend")
+	}
+}
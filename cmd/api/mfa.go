@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/tomasen/realip"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/totp"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+)
+
+// 在验证器应用中显示的发行方名称
+const totpIssuer = "CineLight"
+
+// 开始TOTP注册 返回密钥与otpauth URI 需要通过确认步骤后才会生效
+func (app *application) enrollTOTPHandler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	// 已经开启的TOTP不能被覆盖 需要先关闭
+	userTOTP, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if userTOTP != nil && userTOTP.Confirmed {
+		v := validator.New()
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.MFA.SetTOTP(user.ID, secret)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	env := envelop{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}
+	app.writeJson(c, http.StatusCreated, env, nil)
+}
+
+// 使用第一个验证码确认TOTP注册 返回一次性的恢复码
+func (app *application) confirmTOTPHandler(c *gin.Context) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user := app.contextGetUser(c)
+	userTOTP, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	if userTOTP.Confirmed {
+		v.AddError("code", "two-factor authentication is already enabled")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	step, ok := totp.Validate(userTOTP.Secret, input.Code, app.now())
+	if !ok {
+		v.AddError("code", "invalid verification code")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	codes, err := app.models.MFA.ConfirmTOTP(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"recovery_codes": codes}, nil)
+}
+
+// 关闭TOTP 需要提供有效的验证码或恢复码
+func (app *application) deleteTOTPHandler(c *gin.Context) {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	user := app.contextGetUser(c)
+	userTOTP, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	ok, err := app.verifySecondFactor(userTOTP, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !ok {
+		v := validator.New()
+		v.AddError("code", "invalid verification code")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.MFA.DeleteTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "two-factor authentication successfully disabled"}, nil)
+}
+
+// 使用mfa_pending Token与验证码(或恢复码)换取认证Token
+func (app *application) createMFAAuthenticationTokenHandler(c *gin.Context) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	// 验证码与恢复码至少需要提供一个
+	if input.RecoveryCode == "" {
+		data.ValidateTOTPCode(v, input.Code)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user, err := app.models.User.GetForToken(data.ScopeMFAPending, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 与密码登录共用锁定策略 账号被锁定后同样不能通过验证码完成登录
+	ip := realip.FromRequest(c.Request)
+	if app.loginLocked(c, user.Email, ip) {
+		return
+	}
+	userTOTP, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	ok, err := app.verifySecondFactor(userTOTP, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 无论验证是否成功mfa_pending Token都只能使用一次 防止对验证码进行穷举
+	err = app.models.Token.DeleteAllForUser(data.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !ok {
+		// 错误的验证码计入登录失败次数 防止借助新的mfa_pending Token持续穷举验证码
+		err = app.recordLoginFailure(user.Email, ip, user)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		app.invalidCredentialResponse(c)
+		return
+	}
+	app.issueAuthenticationTokens(c, user)
+}
+
+// 检查用户提供的TOTP验证码或恢复码 验证码对应的时间窗口只能使用一次
+func (app *application) verifySecondFactor(userTOTP *data.TOTP, code, recoveryCode string) (bool, error) {
+	if !userTOTP.Confirmed {
+		return false, nil
+	}
+	if recoveryCode != "" {
+		return app.models.MFA.UseRecoveryCode(userTOTP.UserID, recoveryCode)
+	}
+	step, ok := totp.Validate(userTOTP.Secret, code, app.now())
+	if !ok || step <= userTOTP.LastUsedStep {
+		return false, nil
+	}
+	return app.models.MFA.UseTOTPStep(userTOTP.UserID, step)
+}
@@ -110,15 +110,80 @@ func (app *application) authenticate() gin.HandlerFunc {
 			// 简单的调用中间件链并不会终止当前中间件代码的后续运行
 			return
 		}
-		// 存储在表头中的结构应该是:Authorization: Bearer <Token>
+		// 存储在表头中的结构应该是:Authorization: Bearer <Token> 或 Authorization: ApiKey <Key>
+		// 第三方应用的访问Token同样使用Bearer 通过oat_前缀区分
 		// 提取成功后尝试进行切分并检查是否如预期
 		headerParts := strings.Split(authorizationHeader, " ")
+		// 服务账号使用API秘钥进行认证
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			v := validator2.New()
+			if data.ValidateAPIKeyPlaintext(v, headerParts[1]); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(context)
+				return
+			}
+			user, permissions, err := app.models.APIKeys.GetForKey(headerParts[1])
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(context)
+				default:
+					app.serverErrorResponse(context, err)
+				}
+				return
+			}
+			app.contextSetUser(context, user)
+			// 请求只能使用秘钥被授予的权限
+			app.contextSetPermissionLimit(context, permissions)
+			context.Next()
+			return
+		}
+		// Basic认证由OAuth2的端点自行处理客户端认证 对于用户而言视为匿名
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			app.contextSetUser(context, data.AnonymousUser)
+			context.Next()
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(context)
 			return
 		}
 		// 提取Token进行有效性检测
 		token := headerParts[1]
+		// 签发给第三方应用的访问Token 请求只能使用被授予的scope
+		if strings.HasPrefix(token, data.OAuthTokenPrefix) {
+			v := validator2.New()
+			if data.ValidateOAuthTokenPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(context)
+				return
+			}
+			user, scopes, err := app.models.OAuth.GetForToken(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(context)
+				default:
+					app.serverErrorResponse(context, err)
+				}
+				return
+			}
+			app.contextSetUser(context, user)
+			app.contextSetPermissionLimit(context, scopes)
+			context.Next()
+			return
+		}
+		// 启用JWT时 按照JWT格式验证Token 不需要查询数据库
+		if app.jwtKeys != nil && strings.Count(token, ".") == 2 {
+			user, hash, err := app.userFromJWT(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(context)
+				return
+			}
+			app.contextSetUser(context, user)
+			// jti就是数据库中存储的哈希
+			app.contextSetTokenHash(context, hash)
+			context.Next()
+			return
+		}
 		v := validator2.New()
 		// 若有效性验证失败返回无效的认证秘钥而不是通常使用的无效的验证
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -141,6 +206,8 @@ func (app *application) authenticate() gin.HandlerFunc {
 		}
 		// 验证成功更新当前请求的context信息
 		app.contextSetUser(context, user)
+		// 记录下当前请求使用的Token的哈希
+		app.contextSetTokenHash(context, data.TokenHash(token))
 		// 调用下一个中间件
 		context.Next()
 	}
@@ -173,13 +240,23 @@ func (app *application) requireActivatedUser() gin.HandlerFunc {
 	}
 }
 
+// 拒绝受权限范围限制的请求(API秘钥与第三方应用的Token)
+// 管理账号本身的操作不属于任何权限代码 只允许用户自己登录后执行 否则可以借此绕过被授予的范围
+func (app *application) requireUnrestrictedAccess() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if _, limited := app.contextGetPermissionLimit(context); limited {
+			app.notPermittedResponse(context)
+			return
+		}
+		context.Next()
+	}
+}
+
 // 接收權限的代碼映射數據庫中的權限類型
 func (app *application) requirePermission(code string) gin.HandlerFunc {
 	return func(context *gin.Context) {
-		// 先從ctx中提取出當前用戶的信息
-		user := app.contextGetUser(context)
-		// 從數據庫中查詢當前用戶擁有的權限
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// 提取當前用戶擁有的權限 同一個請求中只會查詢一次
+		permissions, err := app.contextGetPermissions(context)
 		if err != nil {
 			app.serverErrorResponse(context, err)
 			return
@@ -190,6 +267,11 @@ func (app *application) requirePermission(code string) gin.HandlerFunc {
 			app.notPermittedResponse(context)
 			return
 		}
+		// 若請求受到權限範圍的限制(例如使用API秘鑰) 還需要檢查權限是否在範圍內
+		if limit, ok := app.contextGetPermissionLimit(context); ok && !limit.Include(code) {
+			app.notPermittedResponse(context)
+			return
+		}
 		// 有對應的權限則調用下一個中間件
 		context.Next()
 	}
@@ -162,9 +162,10 @@ func (app *application) listMoviesHandler(c *gin.Context) {
 	// 保持代码风格一致
 	// 定义input结构体存储可能会有的数据
 	var input struct {
-		Title        string
-		Genres       []string
-		data.Filters // 直接嵌入字段
+		Title          string
+		Genres         []string
+		ExcludeWatched bool // 排除当前用户已经看过的电影
+		data.Filters        // 直接嵌入字段
 	}
 	// 创建新的验证器
 	v := validator.New()
@@ -174,20 +175,25 @@ func (app *application) listMoviesHandler(c *gin.Context) {
 	input.Title = app.readString(qs, "title", "")
 	// 注意这里slice要初始化后返回
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.ExcludeWatched = app.readBool(qs, "exclude_watched", false, v)
 	// 尝试获取page范围 默认值分别为1与20
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	// 提取排序信息 默认按id排序
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// 添加排序的允许值
-	input.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.SortSafeList = []string{"id", "title", "year", "runtime", "rating", "votes", "-id", "-title", "-year", "-runtime", "-rating", "-votes"}
 	// 检查数据的有效性
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(c, v.Errors)
 		return
 	}
 	// 按输入逻辑进行查询
-	movies, metaData, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	var excludeWatchedBy int64
+	if input.ExcludeWatched {
+		excludeWatchedBy = app.contextGetUser(c).ID
+	}
+	movies, metaData, err := app.models.Movies.GetAll(input.Title, input.Genres, excludeWatchedBy, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(c, err)
 		return
@@ -263,3 +269,52 @@ func (app *application) updateMovieTestHandler(c *gin.Context) {
 	// 向响应体输出更改成功后的新数据
 	app.writeJson(c, http.StatusOK, envelop{"movie": movie}, nil)
 }
+
+// 列出已经删除但尚未彻底清除的电影 支持分页与排序
+func (app *application) listDeletedMoviesHandler(c *gin.Context) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// 默认最近删除的在前
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.SortSafeList = []string{"id", "title", "deleted_at", "-id", "-title", "-deleted_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	movies, metaData, err := app.models.Movies.GetAllDeleted(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"movies": movies, "metadata": metaData}, nil)
+}
+
+// 恢复已经删除的电影
+func (app *application) restoreMovieHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Movies.Restore(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"movie": movie}, nil)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/auth"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 授权码与访问Token的有效期
+const (
+	oauthCodeTTL        = 10 * time.Minute
+	oauthAccessTokenTTL = time.Hour
+)
+
+// 注册新的第三方应用 机密客户端的秘钥只会在这里返回一次
+func (app *application) createOAuthClientHandler(c *gin.Context) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	client := &data.OAuthClient{
+		Name:         input.Name,
+		OwnerID:      app.contextGetUser(c).ID,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+	}
+	v := validator.New()
+	data.ValidateOAuthClient(v, client)
+	// scope与权限代码一一对应
+	err = app.checkPermissionCodes(v, client.Scopes)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusCreated, envelop{"client": client}, nil)
+}
+
+// 列出所有的第三方应用
+func (app *application) listOAuthClientsHandler(c *gin.Context) {
+	clients, err := app.models.OAuth.GetAllClients()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"clients": clients}, nil)
+}
+
+// 删除第三方应用 同时使其所有的Token失效
+func (app *application) deleteOAuthClientHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.OAuth.DeleteClient(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "client successfully deleted"}, nil)
+}
+
+// 第三方应用发起的授权请求
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type" form:"response_type"`
+	ClientID            string `json:"client_id" form:"client_id"`
+	RedirectURI         string `json:"redirect_uri" form:"redirect_uri"`
+	Scope               string `json:"scope" form:"scope"`
+	State               string `json:"state" form:"state"`
+	CodeChallenge       string `json:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" form:"code_challenge_method"`
+}
+
+// 检查授权请求 返回第三方应用与最终授予的scope 失败时已经写入了响应体
+// 授予的scope不能超出应用注册的范围与当前用户拥有的权限
+func (app *application) readAuthorizationRequest(c *gin.Context, req *authorizationRequest) (*data.OAuthClient, data.Permissions, bool) {
+	v := validator.New()
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	// 只支持S256方式的PKCE
+	v.Check(req.CodeChallenge != "", "code_challenge", "must be provided")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	client, err := app.models.OAuth.GetClient(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, nil, false
+	}
+	// 回调地址必须与注册的完全一致 只注册了一个时可以省略
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	if !validator.In(req.RedirectURI, client.RedirectURIs...) {
+		v.AddError("redirect_uri", "does not match a registered redirect uri")
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	permissions, err := app.contextGetPermissions(c)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return nil, nil, false
+	}
+	scopes, ok := grantableScopes(req.Scope, client.Scopes, permissions)
+	if !ok {
+		v.AddError("scope", "must be a subset of the client's scopes and your permissions")
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	return client, scopes, true
+}
+
+// 展示授权请求的内容 前端据此向用户展示同意页面
+func (app *application) showOAuthAuthorizationHandler(c *gin.Context) {
+	var req authorizationRequest
+	err := c.ShouldBindQuery(&req)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	client, scopes, ok := app.readAuthorizationRequest(c, &req)
+	if !ok {
+		return
+	}
+	env := envelop{
+		"client": envelop{"client_id": client.ClientID, "name": client.Name},
+		"scopes": scopes,
+	}
+	app.writeJson(c, http.StatusOK, env, nil)
+}
+
+// 用户同意或拒绝授权 返回应用的回调地址 由前端负责跳转
+func (app *application) createOAuthAuthorizationHandler(c *gin.Context) {
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	client, scopes, ok := app.readAuthorizationRequest(c, &input.authorizationRequest)
+	if !ok {
+		return
+	}
+	params := url.Values{}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+	if !input.Approve {
+		params.Set("error", "access_denied")
+	} else {
+		code, err := app.models.OAuth.NewCode(&data.OAuthCode{
+			ClientID:      client.ClientID,
+			UserID:        app.contextGetUser(c).ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: input.CodeChallenge,
+		}, oauthCodeTTL)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		params.Set("code", code)
+	}
+	sep := "?"
+	if strings.Contains(input.RedirectURI, "?") {
+		sep = "&"
+	}
+	app.writeJson(c, http.StatusOK, envelop{"redirect_uri": input.RedirectURI + sep + params.Encode()}, nil)
+}
+
+// 令牌端点(RFC 6749) 支持authorization_code与client_credentials两种授权方式
+func (app *application) oauthTokenHandler(c *gin.Context) {
+	// 令牌端点的响应不能被缓存
+	c.Header("Cache-Control", "no-store")
+	client, authenticated, ok := app.readOAuthClient(c)
+	if !ok {
+		return
+	}
+	var (
+		userID int64
+		scopes data.Permissions
+	)
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		// 机密客户端必须进行认证
+		if client.Confidential && !authenticated {
+			app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return
+		}
+		code, err := app.models.OAuth.ConsumeCode(c.PostForm("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(c, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			default:
+				app.serverErrorResponse(c, err)
+			}
+			return
+		}
+		// 授权码必须由同一个应用使用同一个回调地址兑换 并且通过PKCE的验证
+		if code.ClientID != client.ClientID || code.RedirectURI != c.PostForm("redirect_uri") ||
+			auth.CodeChallenge(c.PostForm("code_verifier")) != code.CodeChallenge {
+			app.oauthErrorResponse(c, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			return
+		}
+		userID, scopes = code.UserID, code.Scopes
+	case "client_credentials":
+		// 只有机密客户端可以使用 以应用所有者的身份访问
+		if !authenticated {
+			app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return
+		}
+		permissions, err := app.userPermissions(client.OwnerID)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		var granted bool
+		scopes, granted = grantableScopes(c.PostForm("scope"), client.Scopes, permissions)
+		if !granted {
+			app.oauthErrorResponse(c, http.StatusBadRequest, "invalid_scope", "requested scope is not allowed")
+			return
+		}
+		userID = client.OwnerID
+	default:
+		app.oauthErrorResponse(c, http.StatusBadRequest, "unsupported_grant_type", "grant type must be authorization_code or client_credentials")
+		return
+	}
+	token, err := app.models.OAuth.NewToken(client.ClientID, userID, scopes, oauthAccessTokenTTL)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 令牌端点的响应格式由RFC 6749规定 不使用envelop
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(oauthAccessTokenTTL.Seconds()),
+		"scope":        strings.Join(token.Scopes, " "),
+	})
+}
+
+// 令牌内省(RFC 7662) 只有机密客户端可以查询 并且只能查询自己的Token
+func (app *application) oauthIntrospectHandler(c *gin.Context) {
+	client, authenticated, ok := app.readOAuthClient(c)
+	if !ok {
+		return
+	}
+	if !authenticated {
+		app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	token, err := app.models.OAuth.GetToken(c.PostForm("token"))
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 无效、过期或不属于当前应用的Token都只返回active:false
+	if token == nil || token.ClientID != client.ClientID {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active":     true,
+		"scope":      strings.Join(token.Scopes, " "),
+		"client_id":  token.ClientID,
+		"sub":        fmt.Sprint(token.UserID),
+		"token_type": "Bearer",
+		"iat":        token.CreatedAt.Unix(),
+		"exp":        token.Expiry.Unix(),
+	})
+}
+
+// 令牌撤销(RFC 7009) 无论Token是否有效都返回200
+func (app *application) oauthRevokeHandler(c *gin.Context) {
+	client, authenticated, ok := app.readOAuthClient(c)
+	if !ok {
+		return
+	}
+	// 公共客户端没有秘钥 只需要提供client_id
+	if client.Confidential && !authenticated {
+		app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	err := app.models.OAuth.RevokeToken(c.PostForm("token"), client.ClientID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// 从Basic认证头或表单中读取第三方应用 第二个返回值表示是否通过了秘钥认证
+// 失败时已经写入了响应体
+func (app *application) readOAuthClient(c *gin.Context) (*data.OAuthClient, bool, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// Basic认证中的值经过了表单编码
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false, false
+	}
+	// 提供了秘钥就必须正确
+	if secret != "" && !client.MatchesSecret(secret) {
+		app.oauthErrorResponse(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false, false
+	}
+	return client, secret != "", true
+}
+
+// 计算最终授予的scope 未指定时授予应用与用户权限的交集
+// 指定的scope超出应用注册的范围或用户的权限时返回false
+func grantableScopes(requested string, clientScopes, permissions data.Permissions) (data.Permissions, bool) {
+	scopes := data.Permissions{}
+	if requested == "" {
+		for _, scope := range clientScopes {
+			if permissions.Include(scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes, len(scopes) > 0
+	}
+	for _, scope := range strings.Fields(requested) {
+		if !clientScopes.Include(scope) || !permissions.Include(scope) {
+			return nil, false
+		}
+		if !scopes.Include(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, len(scopes) > 0
+}
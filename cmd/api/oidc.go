@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tomasen/realip"
+	"greenlight.vdebu.net/internal/auth"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 从跳转到IdP到回调之间允许的最长时间
+const oidcStateTTL = 10 * time.Minute
+
+// 邀请注册模式下外部身份没有对应的本地账号
+var errRegistrationClosed = errors.New("registration closed")
+
+// IdP提供的名称或邮箱无法通过本地账号的有效性检查
+var errInvalidIdentity = errors.New("invalid identity")
+
+// 解析-oidc-provider参数 格式为逗号分隔的key=value
+// 未提供client-secret时从环境变量CINELIGHT_OIDC_<NAME>_CLIENT_SECRET中读取 避免秘钥出现在进程参数中
+func parseOIDCProvider(spec string) (*auth.Provider, error) {
+	var cfg auth.Config
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid oidc provider field %q, expected key=value", field)
+		}
+		switch key {
+		case "name":
+			cfg.Name = value
+		case "issuer":
+			cfg.Issuer = value
+		case "client-id":
+			cfg.ClientID = value
+		case "client-secret":
+			cfg.ClientSecret = value
+		case "redirect-url":
+			cfg.RedirectURL = value
+		case "scopes":
+			cfg.Scopes = strings.Fields(value)
+		default:
+			return nil, fmt.Errorf("unknown oidc provider field %q", key)
+		}
+	}
+	if cfg.ClientSecret == "" {
+		cfg.ClientSecret = os.Getenv("CINELIGHT_OIDC_" + strings.ToUpper(strings.ReplaceAll(cfg.Name, "-", "_")) + "_CLIENT_SECRET")
+	}
+	return auth.NewProvider(cfg)
+}
+
+// 开始OIDC登录 生成state、nonce与PKCE的code_verifier后跳转到IdP
+func (app *application) oidcLoginHandler(c *gin.Context) {
+	provider, ok := app.authProviders[c.Param("provider")]
+	if !ok {
+		app.notFoundResponse(c)
+		return
+	}
+	var state data.OIDCState
+	statePlaintext, err := auth.RandomString()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	state.Provider = provider.Name()
+	state.Nonce, err = auth.RandomString()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	state.CodeVerifier, err = auth.RandomString()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	redirectURL, err := provider.AuthCodeURL(c.Request.Context(), statePlaintext, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Identities.InsertState(statePlaintext, &state, oidcStateTTL)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// IdP的回调 使用授权码换取ID Token 找到或创建对应的本地用户后签发认证Token
+func (app *application) oidcCallbackHandler(c *gin.Context) {
+	provider, ok := app.authProviders[c.Param("provider")]
+	if !ok {
+		app.notFoundResponse(c)
+		return
+	}
+	// 用户在IdP拒绝了授权或IdP返回了错误
+	if idpError := c.Query("error"); idpError != "" {
+		app.badRequestResponse(c, fmt.Errorf("identity provider returned error %q", idpError))
+		return
+	}
+	code, statePlaintext := c.Query("code"), c.Query("state")
+	if code == "" || statePlaintext == "" {
+		app.badRequestResponse(c, errors.New("missing code or state"))
+		return
+	}
+	// state只能使用一次 并且必须属于当前的IdP
+	state, err := app.models.Identities.ConsumeState(statePlaintext, provider.Name())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.badRequestResponse(c, errors.New("invalid or expired state"))
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	claims, err := provider.Exchange(c.Request.Context(), code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrInvalidIDToken):
+			app.invalidCredentialResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	user, ok := app.userForIdentity(c, provider.Name(), claims)
+	if !ok {
+		return
+	}
+	// 因多次登录失败被锁定的账号同样不能通过外部身份登录
+	if app.loginLocked(c, user.Email, realip.FromRequest(c.Request)) {
+		return
+	}
+	// 外部身份只替代了密码 开启了二次验证的账号仍然需要提供验证码
+	app.completeLogin(c, user)
+}
+
+// 查找外部身份对应的本地用户 没有关联时通过已验证的邮箱关联或创建新的用户
+// 失败时已经写入了响应体
+func (app *application) userForIdentity(c *gin.Context, provider string, claims *auth.IDClaims) (*data.User, bool) {
+	user, err := app.models.Identities.GetUser(provider, claims.Subject)
+	if err == nil {
+		return user, true
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return nil, false
+	}
+	// 只有IdP确认过的邮箱才能用于关联已有的账号 否则任何人都可以冒充
+	if claims.Email == "" || !claims.EmailVerified {
+		app.invalidCredentialResponse(c)
+		return nil, false
+	}
+	// 创建用户、授予权限与关联外部身份在同一个事务中完成 任何一步失败都不会留下占用邮箱的账号
+	replaced := false
+	err = app.models.Transaction(func(tx data.Models) error {
+		var err error
+		user, err = tx.User.GetByEmail(claims.Email)
+		// 未激活的账号没有证明过邮箱的所有权 可能是其他人抢先用这个邮箱注册的
+		// 直接关联会让邮箱的真正拥有者登录进一个密码被他人掌握的账号 因此删除后重新创建
+		if err == nil && !user.Activated {
+			err = tx.User.DeleteIfUnactivated(user.ID)
+			if err != nil {
+				return err
+			}
+			replaced = true
+			err = data.ErrRecordNotFound
+		}
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// 邀请注册模式下不自动创建账号
+			if app.config.registration.mode == registrationInvite {
+				return errRegistrationClosed
+			}
+			user, err = app.createIdentityUser(tx, claims)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+		return tx.Identities.Insert(&data.Identity{
+			UserID:   user.ID,
+			Provider: provider,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errRegistrationClosed):
+			app.registrationClosedResponse(c)
+		case errors.Is(err, errInvalidIdentity):
+			app.invalidCredentialResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	if replaced {
+		app.logger.PrintInfo("unactivated account replaced by external identity", map[string]string{
+			"provider": provider,
+			"email":    claims.Email,
+		})
+		// 被删除账号的认证Token已经写入撤销列表
+		app.syncDenylist()
+	}
+	return user, true
+}
+
+// 为第一次登录的外部身份创建本地用户 邮箱已经由IdP验证所以直接激活
+func (app *application) createIdentityUser(tx data.Models, claims *auth.IDClaims) (*data.User, error) {
+	// 名称由IdP提供 为空或超过本地的长度限制时使用邮箱代替
+	// 否则用户之后每次修改资料都会因为自己没有提交过的字段而无法通过检查
+	name := strings.TrimSpace(claims.Name)
+	if name == "" || len(name) > 500 {
+		name = claims.Email
+	}
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+	// 使用随机的密码 用户需要通过重置密码才能使用本地密码登录
+	password, err := auth.RandomString()
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+	// 与注册时相同的检查 IdP提供的邮箱同样可能无法通过
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.logger.PrintInfo("external identity rejected by user validation", map[string]string{
+			"email":  claims.Email,
+			"errors": fmt.Sprint(v.Errors),
+		})
+		return nil, errInvalidIdentity
+	}
+	err = tx.User.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Permissions.AddForUser(user.ID, defaultUserPermissions...)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
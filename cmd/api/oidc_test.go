@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"greenlight.vdebu.net/internal/auth"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/jsonlog"
+	"io"
+	"strings"
+	"testing"
+)
+
+// 无法通过检查的身份在写入数据库之前就被拒绝 因此不需要数据库
+func TestCreateIdentityUserRejectsInvalidEmail(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelInfo)}
+	for _, email := range []string{"not-an-email", strings.Repeat("a", 600) + "@example.com"} {
+		claims := &auth.IDClaims{
+			Subject:       "1234",
+			Email:         email,
+			EmailVerified: true,
+			Name:          strings.Repeat("n", 600),
+		}
+		_, err := app.createIdentityUser(data.Models{}, claims)
+		if !errors.Is(err, errInvalidIdentity) {
+			t.Errorf("email %.20q: got error %v; want %v", email, err, errInvalidIdentity)
+		}
+	}
+}
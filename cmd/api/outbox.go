@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/mailer"
+	"net/http"
+	"time"
+)
+
+// 发件箱的投递策略
+const (
+	outboxPollInterval = time.Second      // 没有待发送的邮件时的轮询间隔
+	outboxBatchSize    = 5                // 每次领取的邮件数量
+	outboxLease        = time.Minute      // 领取后其他发送者不会再领取的时间
+	outboxRetryBase    = 10 * time.Second // 第一次重试的等待时间 之后每次翻倍
+	outboxRetryMax     = time.Hour        // 重试等待时间的上限
+	outboxRetention    = 7 * 24 * time.Hour
+)
+
+// 发件箱的投递统计 通过/debug/vars中的email_outbox查看
+var outboxStats = expvar.NewMap("email_outbox")
+
+// 渲染邮件并写入发件箱 传入事务中的模型时邮件与事务中的其他数据一起提交
+func (app *application) queueEmail(outbox data.OutboxModel, recipient, templateFile string, emailData interface{}) error {
+	message, err := mailer.Render(templateFile, emailData)
+	if err != nil {
+		return err
+	}
+	return outbox.Insert(&data.OutboxMessage{
+		Recipient: recipient,
+		Subject:   message.Subject,
+		PlainBody: message.PlainBody,
+		HTMLBody:  message.HTMLBody,
+	})
+}
+
+// 启动n个发件箱的发送者 服务器开始关闭时退出
+func (app *application) startOutboxWorkers(n int) {
+	for i := 0; i < n; i++ {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-app.shutdown:
+					return
+				case <-ticker.C:
+					app.deliverOutbox()
+				}
+			}
+		}()
+	}
+}
+
+// 领取一批到期的邮件并逐个发送
+func (app *application) deliverOutbox() {
+	messages, err := app.models.Outbox.Claim(outboxBatchSize, outboxLease)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	for _, msg := range messages {
+		// 服务器正在关闭 剩余的邮件在领取过期后重新发送
+		select {
+		case <-app.shutdown:
+			return
+		default:
+		}
+		app.deliverEmail(msg)
+	}
+}
+
+// 发送一封邮件并记录结果 失败时按指数退避安排重试 超过最大次数后放弃
+func (app *application) deliverEmail(msg *data.OutboxMessage) {
+	err := app.mailer.Send(msg.Recipient, &mailer.Message{
+		Subject:   msg.Subject,
+		PlainBody: msg.PlainBody,
+		HTMLBody:  msg.HTMLBody,
+	})
+	if err == nil {
+		outboxStats.Add("sent", 1)
+		err = app.models.Outbox.MarkSent(msg.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	dead := msg.Attempts >= app.config.outbox.maxAttempts
+	if dead {
+		outboxStats.Add("dead", 1)
+	} else {
+		outboxStats.Add("failed", 1)
+	}
+	app.logger.PrintError(err, map[string]string{
+		"email_id": fmt.Sprint(msg.ID),
+		"attempts": fmt.Sprint(msg.Attempts),
+		"dead":     fmt.Sprint(dead),
+	})
+	err = app.models.Outbox.MarkFailed(msg.ID, err.Error(), dead, time.Now().Add(outboxBackoff(msg.Attempts)))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// 第attempts次发送失败后需要等待的时间
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxRetryBase
+	for i := 1; i < attempts && backoff < outboxRetryMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxRetryMax)
+}
+
+// 列出发送失败的邮件 包括已经放弃的与等待重试的
+func (app *application) listFailedEmailsHandler(c *gin.Context) {
+	messages, err := app.models.Outbox.GetAllFailed()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"emails": messages}, nil)
+}
+
+// 将已经放弃的邮件重新加入发送队列
+// 邮件按原来渲染的正文发送 其中的激活/重置密码Token可能已经过期
+func (app *application) requeueEmailHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	msg, err := app.models.Outbox.Requeue(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"email": msg}, nil)
+}
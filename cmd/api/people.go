@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"strconv"
+)
+
+// 创建新的演职人员
+func (app *application) createPersonHandler(c *gin.Context) {
+	var input struct {
+		Name      string `json:"name"`
+		BirthYear *int32 `json:"birth_year"`
+		Biography string `json:"biography"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	person := &data.Person{
+		Name:      input.Name,
+		BirthYear: input.BirthYear,
+		Biography: input.Biography,
+	}
+	v := validator.New()
+	if data.ValidatePerson(v, person); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.People.Insert(person)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/people/%d", person.ID))
+	app.writeJson(c, http.StatusCreated, envelop{"person": person}, headers)
+}
+
+// 查询路由参数中的演职人员 失败时已经写入了响应体
+func (app *application) readPersonParam(c *gin.Context) (*data.Person, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return nil, false
+	}
+	person, err := app.models.People.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return person, true
+}
+
+// 展示演职人员的信息
+func (app *application) showPersonHandler(c *gin.Context) {
+	person, ok := app.readPersonParam(c)
+	if !ok {
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"person": person}, nil)
+}
+
+// 更新演职人员的信息 只更新请求中提供的字段
+func (app *application) updatePersonHandler(c *gin.Context) {
+	person, ok := app.readPersonParam(c)
+	if !ok {
+		return
+	}
+	// 使用指针区分未提供的字段与空值
+	var input struct {
+		Name      *string `json:"name"`
+		BirthYear *int32  `json:"birth_year"`
+		Biography *string `json:"biography"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	if input.Name != nil {
+		person.Name = *input.Name
+	}
+	if input.BirthYear != nil {
+		person.BirthYear = input.BirthYear
+	}
+	if input.Biography != nil {
+		person.Biography = *input.Biography
+	}
+	v := validator.New()
+	if data.ValidatePerson(v, person); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.People.Update(person)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"person": person}, nil)
+}
+
+// 删除演职人员
+func (app *application) deletePersonHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.People.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "person successfully deleted"}, nil)
+}
+
+// 列出演职人员 支持按名字搜索、分页与排序
+func (app *application) listPeopleHandler(c *gin.Context) {
+	var input struct {
+		Name string
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.SortSafeList = []string{"id", "name", "birth_year", "-id", "-name", "-birth_year"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	people, metaData, err := app.models.People.GetAll(input.Name, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"people": people, "metadata": metaData}, nil)
+}
+
+// 列出演职人员参与的所有电影
+func (app *application) showPersonFilmographyHandler(c *gin.Context) {
+	person, ok := app.readPersonParam(c)
+	if !ok {
+		return
+	}
+	credits, err := app.models.People.GetFilmography(person.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"person": person, "filmography": credits}, nil)
+}
+
+// 查询路由参数中的电影 失败时已经写入了响应体
+func (app *application) readMovieParam(c *gin.Context) (*data.Movie, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return nil, false
+	}
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return movie, true
+}
+
+// 列出电影的演职人员
+func (app *application) listMovieCreditsHandler(c *gin.Context) {
+	movie, ok := app.readMovieParam(c)
+	if !ok {
+		return
+	}
+	credits, err := app.models.People.GetCreditsForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"credits": credits}, nil)
+}
+
+// 为电影添加演职人员
+func (app *application) createMovieCreditHandler(c *gin.Context) {
+	movie, ok := app.readMovieParam(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		PersonID     int64  `json:"person_id"`
+		Role         string `json:"role"`
+		Character    string `json:"character"`
+		BillingOrder int32  `json:"billing_order"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	credit := &data.Credit{
+		MovieID:      movie.ID,
+		PersonID:     input.PersonID,
+		Role:         input.Role,
+		Character:    input.Character,
+		BillingOrder: input.BillingOrder,
+	}
+	v := validator.New()
+	if data.ValidateCredit(v, credit); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	credit.Person, err = app.models.People.Get(credit.PersonID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("person_id", "does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	err = app.models.People.InsertCredit(credit)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCredit):
+			v.AddError("person_id", "already has this role in the movie")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusCreated, envelop{"credit": credit}, nil)
+}
+
+// 删除电影中的某个职务
+func (app *application) deleteMovieCreditHandler(c *gin.Context) {
+	movieID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	creditID, err := strconv.ParseInt(c.Param("credit_id"), 10, 64)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.People.DeleteCredit(movieID, creditID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "credit successfully deleted"}, nil)
+}
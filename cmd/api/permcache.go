@@ -0,0 +1,97 @@
+package main
+
+import (
+	"expvar"
+	"greenlight.vdebu.net/internal/data"
+	"sync"
+	"time"
+)
+
+// 进程内的用户权限缓存 避免每个受保护的请求都查询数据库
+// 多实例部署时其他实例的变更无法主动失效 最多在ttl之后才会生效
+type permissionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int64]permissionCacheEntry
+	hits    *expvar.Int
+	misses  *expvar.Int
+}
+
+// 缓存中的一条记录
+type permissionCacheEntry struct {
+	permissions data.Permissions
+	expiry      time.Time
+}
+
+// 创建新的权限缓存 并通过expvar发布命中与未命中的次数(只能调用一次)
+func newPermissionCache(ttl time.Duration) *permissionCache {
+	return &permissionCache{
+		ttl:     ttl,
+		entries: make(map[int64]permissionCacheEntry),
+		hits:    expvar.NewInt("permissions_cache_hits"),
+		misses:  expvar.NewInt("permissions_cache_misses"),
+	}
+}
+
+// 获取用户的权限 未启用缓存(nil)时总是返回false
+func (pc *permissionCache) get(userID int64) (data.Permissions, bool) {
+	if pc == nil {
+		return nil, false
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	entry, ok := pc.entries[userID]
+	if !ok || time.Now().After(entry.expiry) {
+		delete(pc.entries, userID)
+		pc.misses.Add(1)
+		return nil, false
+	}
+	pc.hits.Add(1)
+	return entry.permissions, true
+}
+
+// 缓存用户的权限
+func (pc *permissionCache) set(userID int64, permissions data.Permissions) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.entries[userID] = permissionCacheEntry{
+		permissions: permissions,
+		expiry:      time.Now().Add(pc.ttl),
+	}
+}
+
+// 使指定用户的缓存失效 用户的权限或角色发生变化时调用
+func (pc *permissionCache) invalidate(userID int64) {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.entries, userID)
+}
+
+// 清空所有的缓存 角色本身发生变化时会影响到所有拥有该角色的用户
+func (pc *permissionCache) invalidateAll() {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	clear(pc.entries)
+}
+
+// 查询用户的权限 启用缓存时优先使用缓存
+func (app *application) userPermissions(userID int64) (data.Permissions, error) {
+	if permissions, ok := app.permissionCache.get(userID); ok {
+		return permissions, nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	app.permissionCache.set(userID, permissions)
+	return permissions, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+)
+
+// 管理用户权限所需的权限代码
+const permissionsAdmin = "permissions:admin"
+
+// 新注册的用户默认拥有的权限
+var defaultUserPermissions = []string{"movie:read", "review:write"}
+
+// 列出所有可用的权限代码
+func (app *application) listPermissionsHandler(c *gin.Context) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"permissions": permissions}, nil)
+}
+
+// 列出指定用户拥有的权限
+func (app *application) listUserPermissionsHandler(c *gin.Context) {
+	user, ok := app.readUserParam(c)
+	if !ok {
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"permissions": permissions}, nil)
+}
+
+// 为指定用户授予权限
+func (app *application) grantUserPermissionsHandler(c *gin.Context) {
+	user, codes, ok := app.readPermissionChange(c)
+	if !ok {
+		return
+	}
+	actor := app.contextGetUser(c)
+	err := app.models.Permissions.Grant(actor.ID, user.ID, codes...)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.showUserPermissions(c, user.ID)
+}
+
+// 撤销指定用户的权限
+func (app *application) revokeUserPermissionsHandler(c *gin.Context) {
+	user, codes, ok := app.readPermissionChange(c)
+	if !ok {
+		return
+	}
+	actor := app.contextGetUser(c)
+	// 防止管理员撤销自己的管理权限导致系统中没有管理员
+	if actor.ID == user.ID && data.Permissions(codes).Include(permissionsAdmin) {
+		v := validator.New()
+		v.AddError("permissions", "you cannot revoke your own "+permissionsAdmin+" permission")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err := app.models.Permissions.Revoke(actor.ID, user.ID, codes...)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.showUserPermissions(c, user.ID)
+}
+
+// 从路径中读取用户ID并查询用户 失败时已经写入了响应体
+func (app *application) readUserParam(c *gin.Context) (*data.User, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return nil, false
+	}
+	user, err := app.models.User.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
+
+// 读取并检查授予或撤销的权限代码 失败时已经写入了响应体
+func (app *application) readPermissionChange(c *gin.Context) (*data.User, []string, bool) {
+	user, ok := app.readUserParam(c)
+	if !ok {
+		return nil, nil, false
+	}
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return nil, nil, false
+	}
+	v := validator.New()
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	// 检查每一个权限代码是否存在
+	err = app.checkPermissionCodes(v, input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return nil, nil, false
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	return user, input.Permissions, true
+}
+
+// 输出用户变更后的权限
+func (app *application) showUserPermissions(c *gin.Context, userID int64) {
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"permissions": permissions}, nil)
+}
+
+// 检查权限代码是否都存在 不存在的代码会被记录到验证器中
+func (app *application) checkPermissionCodes(v *validator.Validator, codes []string) error {
+	all, err := app.models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		v.Check(all.Include(code), "permissions", fmt.Sprintf("unknown permission %q", code))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+)
+
+// 列出电影的评论 支持分页与排序
+func (app *application) listMovieReviewsHandler(c *gin.Context) {
+	movie, ok := app.readMovieParam(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// 默认展示最新的评论
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.SortSafeList = []string{"id", "score", "created_at", "updated_at", "-id", "-score", "-created_at", "-updated_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	reviews, metaData, err := app.models.Reviews.GetAllForMovie(movie.ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"reviews": reviews, "metadata": metaData}, nil)
+}
+
+// 当前用户为电影评分与评论 每个用户对每部电影只能有一条评论
+func (app *application) createMovieReviewHandler(c *gin.Context) {
+	movieID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	var input struct {
+		Score int32  `json:"score"`
+		Body  string `json:"body"`
+	}
+	err = app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	user := app.contextGetUser(c)
+	review := &data.Review{
+		UserID:   user.ID,
+		UserName: user.Name,
+		MovieID:  movieID,
+		Score:    input.Score,
+		Body:     input.Body,
+	}
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Reviews.Insert(review)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		case errors.Is(err, data.ErrDuplicateReview):
+			v.AddError("review", "you have already reviewed this movie")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/movies/%d/reviews", movieID))
+	app.writeJson(c, http.StatusCreated, envelop{"review": review}, headers)
+}
+
+// 修改当前用户对电影的评论 只更新请求中提供的字段
+func (app *application) updateMovieReviewHandler(c *gin.Context) {
+	movieID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	review, err := app.models.Reviews.Get(app.contextGetUser(c).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	var input struct {
+		Score *int32  `json:"score"`
+		Body  *string `json:"body"`
+	}
+	err = app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	if input.Score != nil {
+		review.Score = *input.Score
+	}
+	if input.Body != nil {
+		review.Body = *input.Body
+	}
+	v := validator.New()
+	if data.ValidateReview(v, review); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Reviews.Update(review)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"review": review}, nil)
+}
+
+// 删除当前用户对电影的评论
+func (app *application) deleteMovieReviewHandler(c *gin.Context) {
+	movieID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Reviews.Delete(app.contextGetUser(c).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "review successfully deleted"}, nil)
+}
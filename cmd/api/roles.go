@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+)
+
+// 创建新的角色
+func (app *application) createRoleHandler(c *gin.Context) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+	v := validator.New()
+	data.ValidateRole(v, role)
+	err = app.checkPermissionCodes(v, role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/roles/%d", role.ID))
+	app.writeJson(c, http.StatusCreated, envelop{"role": role}, headers)
+}
+
+// 列出所有的角色
+func (app *application) listRolesHandler(c *gin.Context) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"roles": roles}, nil)
+}
+
+// 展示某个角色
+func (app *application) showRoleHandler(c *gin.Context) {
+	role, ok := app.readRoleParam(c)
+	if !ok {
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"role": role}, nil)
+}
+
+// 更新角色的名称 描述与权限
+func (app *application) updateRoleHandler(c *gin.Context) {
+	role, ok := app.readRoleParam(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	if input.Name != nil {
+		// 内置角色的名称被其他地方依赖 不允许修改
+		v.Check(!role.Builtin || *input.Name == role.Name, "name", "builtin roles cannot be renamed")
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+	data.ValidateRole(v, role)
+	err = app.checkPermissionCodes(v, role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(c, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 角色的权限变化会影响所有拥有该角色的用户
+	app.permissionCache.invalidateAll()
+	app.writeJson(c, http.StatusOK, envelop{"role": role}, nil)
+}
+
+// 删除角色 内置角色不能被删除
+func (app *application) deleteRoleHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Roles.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		case errors.Is(err, data.ErrBuiltinRole):
+			v := validator.New()
+			v.AddError("role", "builtin roles cannot be deleted")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.permissionCache.invalidateAll()
+	app.writeJson(c, http.StatusOK, envelop{"message": "role successfully deleted"}, nil)
+}
+
+// 列出指定用户拥有的角色
+func (app *application) listUserRolesHandler(c *gin.Context) {
+	user, ok := app.readUserParam(c)
+	if !ok {
+		return
+	}
+	app.showUserRoles(c, user.ID)
+}
+
+// 为指定用户分配角色
+func (app *application) addUserRolesHandler(c *gin.Context) {
+	user, names, ok := app.readRoleChange(c)
+	if !ok {
+		return
+	}
+	err := app.models.Roles.AddForUser(app.contextGetUser(c).ID, user.ID, names...)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.showUserRoles(c, user.ID)
+}
+
+// 移除指定用户的角色
+func (app *application) removeUserRolesHandler(c *gin.Context) {
+	user, names, ok := app.readRoleChange(c)
+	if !ok {
+		return
+	}
+	err := app.models.Roles.RemoveForUser(app.contextGetUser(c).ID, user.ID, names...)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.permissionCache.invalidate(user.ID)
+	app.showUserRoles(c, user.ID)
+}
+
+// 从路径中读取角色ID并查询角色 失败时已经写入了响应体
+func (app *application) readRoleParam(c *gin.Context) (*data.Role, bool) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return nil, false
+	}
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return nil, false
+	}
+	return role, true
+}
+
+// 读取并检查分配或移除的角色名称 失败时已经写入了响应体
+func (app *application) readRoleChange(c *gin.Context) (*data.User, []string, bool) {
+	user, ok := app.readUserParam(c)
+	if !ok {
+		return nil, nil, false
+	}
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return nil, nil, false
+	}
+	v := validator.New()
+	v.Check(len(input.Roles) >= 1, "roles", "must contain at least 1 role")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	// 检查每一个角色是否存在
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return nil, nil, false
+	}
+	names := make([]string, len(roles))
+	for i := range roles {
+		names[i] = roles[i].Name
+	}
+	for _, name := range input.Roles {
+		v.Check(validator.In(name, names...), "roles", fmt.Sprintf("unknown role %q", name))
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return nil, nil, false
+	}
+	return user, input.Roles, true
+}
+
+// 输出用户变更后的角色
+func (app *application) showUserRoles(c *gin.Context, userID int64) {
+	roles, err := app.models.Roles.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"roles": roles}, nil)
+}
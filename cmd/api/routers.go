@@ -20,6 +20,10 @@ func (app *application) routers() *gin.Engine {
 		// 用户相关
 		v1.POST("/users", app.registerUserHandler)
 		v1.PUT("/users/activated", app.activateUserHandler)
+		// 使用重置密码的Token设置新密码
+		v1.PUT("/users/password", app.updateUserPasswordHandler)
+		// 使用邮件中的Token确认新的邮箱
+		v1.PUT("/users/email", app.confirmUserEmailHandler)
 		// gin默认没有为处理器注册OPTIONS方法 需要进行显示处理
 		// 添加空的OPTIONS处理方法仅用于处理预检请求
 		v1.OPTIONS("/tokens/authentication", func(c *gin.Context) {
@@ -27,11 +31,108 @@ func (app *application) routers() *gin.Engine {
 		})
 		// 激活账号
 		v1.POST("/tokens/authentication", app.createAuthenticationTokenHandler)
+		// 登出 撤销当前请求使用的认证Token(未激活的账号同样可以登出)
+		v1.DELETE("/tokens/authentication", app.requireAuthenticatedUser(), app.deleteAuthenticationTokenHandler)
+		// 开启二次验证的账号使用验证码完成登录
+		v1.POST("/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+		// 使用刷新Token换取新的认证Token
+		v1.POST("/tokens/refresh", app.createRefreshTokenHandler)
+		// 重新发送激活邮件
+		v1.POST("/tokens/activation", app.createActivationTokenHandler)
+		// 申请重置密码的Token
+		v1.POST("/tokens/password-reset", app.createPasswordResetTokenHandler)
+		// OAuth2授权服务器 第三方应用使用的端点
+		v1.POST("/oauth/token", app.oauthTokenHandler)
+		v1.POST("/oauth/introspect", app.oauthIntrospectHandler)
+		v1.POST("/oauth/revoke", app.oauthRevokeHandler)
+		// 使用外部身份提供方(OIDC)登录
+		v1.GET("/auth/:provider/login", app.oidcLoginHandler)
+		v1.GET("/auth/:provider/callback", app.oidcCallbackHandler)
+		// 公开的片单与通过分享链接查看片单 不需要登录
+		v1.GET("/lists", app.listPublicListsHandler)
+		v1.GET("/lists/:slug", app.showSharedListHandler)
 		// 权限敏感的路由组
 		private := v1.Group("")
 		// 先判断是否认证(登录)再判断是否激活
 		private.Use(app.requireAuthenticatedUser(), app.requireActivatedUser())
 		{
+			// 管理当前用户账号与个人数据的路由组 API秘钥与第三方应用的Token不能访问
+			// 否则只被授予了movie:read的秘钥也能创建新的秘钥、导出数据或开启二次验证
+			account := private.Group("", app.requireUnrestrictedAccess())
+			{
+				// 当前用户的会话管理
+				account.GET("/users/me/sessions", app.listUserSessionsHandler)
+				account.DELETE("/users/me/sessions/:id", app.deleteUserSessionHandler)
+				// 当前用户的资料
+				account.GET("/users/me", app.showCurrentUserHandler)
+				account.PATCH("/users/me", app.updateCurrentUserHandler)
+				// 导出当前用户的数据与删除账号
+				account.GET("/users/me/export", app.exportUserDataHandler)
+				account.DELETE("/users/me", app.deleteCurrentUserHandler)
+				account.DELETE("/users/me/deletion", app.cancelUserDeletionHandler)
+				account.PUT("/users/me/password", app.updateCurrentUserPasswordHandler)
+				// 想看列表与观看记录
+				account.GET("/users/me/watchlist", app.listWatchlistHandler)
+				account.POST("/users/me/watchlist", app.addToWatchlistHandler)
+				account.DELETE("/users/me/watchlist/:id", app.removeFromWatchlistHandler)
+				account.GET("/users/me/history", app.listHistoryHandler)
+				account.POST("/users/me/history", app.addToHistoryHandler)
+				account.DELETE("/users/me/history/:id", app.deleteFromHistoryHandler)
+				account.GET("/users/me/history/export", app.exportHistoryHandler)
+				// 当前用户的片单
+				account.GET("/users/me/lists", app.listUserListsHandler)
+				account.POST("/users/me/lists", app.createListHandler)
+				account.GET("/users/me/lists/:id", app.showUserListHandler)
+				account.PATCH("/users/me/lists/:id", app.updateListHandler)
+				account.DELETE("/users/me/lists/:id", app.deleteListHandler)
+				account.POST("/users/me/lists/:id/slug", app.regenerateListSlugHandler)
+				account.POST("/users/me/lists/:id/items", app.addListItemHandler)
+				account.PUT("/users/me/lists/:id/items", app.reorderListItemsHandler)
+				account.DELETE("/users/me/lists/:id/items/:movie_id", app.removeListItemHandler)
+				// 用户同意第三方应用的授权请求
+				account.GET("/oauth/authorize", app.showOAuthAuthorizationHandler)
+				account.POST("/oauth/authorize", app.createOAuthAuthorizationHandler)
+				// 申请修改当前用户的邮箱
+				account.PATCH("/users/me/email", app.updateUserEmailHandler)
+				// 服务账号使用的API秘钥
+				account.POST("/users/me/api-keys", app.createAPIKeyHandler)
+				account.GET("/users/me/api-keys", app.listAPIKeysHandler)
+				account.DELETE("/users/me/api-keys/:id", app.deleteAPIKeyHandler)
+				// TOTP二次验证
+				account.POST("/users/me/mfa/totp", app.enrollTOTPHandler)
+				account.POST("/users/me/mfa/totp/confirm", app.confirmTOTPHandler)
+				account.DELETE("/users/me/mfa/totp", app.deleteTOTPHandler)
+			}
+			// 管理员使用的路由组 管理用户的权限与角色
+			admin := private.Group("", app.requirePermission(permissionsAdmin))
+			{
+				admin.GET("/permissions", app.listPermissionsHandler)
+				admin.GET("/users/:id/permissions", app.listUserPermissionsHandler)
+				admin.POST("/users/:id/permissions", app.grantUserPermissionsHandler)
+				admin.DELETE("/users/:id/permissions", app.revokeUserPermissionsHandler)
+				// 解除因多次登录失败导致的账号锁定
+				admin.DELETE("/users/:id/lock", app.unlockUserHandler)
+				// 发送失败的邮件
+				admin.GET("/emails", app.listFailedEmailsHandler)
+				admin.POST("/emails/:id/requeue", app.requeueEmailHandler)
+				// 第三方应用管理
+				admin.GET("/oauth/clients", app.listOAuthClientsHandler)
+				admin.POST("/oauth/clients", app.createOAuthClientHandler)
+				admin.DELETE("/oauth/clients/:id", app.deleteOAuthClientHandler)
+				// 注册邀请
+				admin.GET("/invitations", app.listInvitationsHandler)
+				admin.POST("/invitations", app.createInvitationHandler)
+				admin.DELETE("/invitations/:id", app.deleteInvitationHandler)
+				// 角色管理
+				admin.GET("/roles", app.listRolesHandler)
+				admin.POST("/roles", app.createRoleHandler)
+				admin.GET("/roles/:id", app.showRoleHandler)
+				admin.PATCH("/roles/:id", app.updateRoleHandler)
+				admin.DELETE("/roles/:id", app.deleteRoleHandler)
+				admin.GET("/users/:id/roles", app.listUserRolesHandler)
+				admin.POST("/users/:id/roles", app.addUserRolesHandler)
+				admin.DELETE("/users/:id/roles", app.removeUserRolesHandler)
+			}
 			// 創建新的路由組 添加檢測用戶權限的中間件(讀寫)
 			movies := private.Group("")
 			{
@@ -43,6 +144,25 @@ func (app *application) routers() *gin.Engine {
 				movies.PATCH("/movies/test/:id", app.requirePermission("movie:write"), app.updateMovieTestHandler)
 				movies.DELETE("/movies/:id", app.requirePermission("movie:write"), app.deleteMovieHandler)
 				movies.GET("/movies", app.requirePermission("movie:read"), app.listMoviesHandler)
+				// 删除的电影在保留期内可以恢复
+				movies.GET("/movies/trash", app.requirePermission("movie:trash"), app.listDeletedMoviesHandler)
+				movies.POST("/movies/:id/restore", app.requirePermission("movie:trash"), app.restoreMovieHandler)
+				// 电影的演职人员
+				movies.GET("/movies/:id/credits", app.requirePermission("movie:read"), app.listMovieCreditsHandler)
+				movies.POST("/movies/:id/credits", app.requirePermission("movie:write"), app.createMovieCreditHandler)
+				movies.DELETE("/movies/:id/credits/:credit_id", app.requirePermission("movie:write"), app.deleteMovieCreditHandler)
+				// 评分与评论 拥有读权限的用户都可以管理自己的评论
+				movies.GET("/movies/:id/reviews", app.requirePermission("movie:read"), app.listMovieReviewsHandler)
+				movies.POST("/movies/:id/reviews", app.requirePermission("review:write"), app.createMovieReviewHandler)
+				movies.PATCH("/movies/:id/reviews", app.requirePermission("review:write"), app.updateMovieReviewHandler)
+				movies.DELETE("/movies/:id/reviews", app.requirePermission("review:write"), app.deleteMovieReviewHandler)
+				// 演职人员 与电影使用相同的读写权限
+				movies.GET("/people", app.requirePermission("movie:read"), app.listPeopleHandler)
+				movies.POST("/people", app.requirePermission("movie:write"), app.createPersonHandler)
+				movies.GET("/people/:id", app.requirePermission("movie:read"), app.showPersonHandler)
+				movies.PATCH("/people/:id", app.requirePermission("movie:write"), app.updatePersonHandler)
+				movies.DELETE("/people/:id", app.requirePermission("movie:write"), app.deletePersonHandler)
+				movies.GET("/people/:id/filmography", app.requirePermission("movie:read"), app.showPersonFilmographyHandler)
 			}
 		}
 	}
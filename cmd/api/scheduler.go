@@ -0,0 +1,176 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+)
+
+// 后台周期性执行的任务
+type job struct {
+	name     string
+	interval time.Duration
+	// 为true时通过数据库咨询锁保证多实例部署时同一时间只有一个实例执行
+	// 需要在每个实例上执行的任务(例如同步内存中的状态)设为false
+	exclusive bool
+	// 返回本次处理的记录数量
+	run func(now time.Time) (int64, error)
+}
+
+// 每个任务的运行统计 通过/debug/vars中的scheduler查看
+var schedulerStats = expvar.NewMap("scheduler")
+
+// 周期性执行的后台任务 服务器关闭时等待正在执行的任务完成
+func (app *application) backgroundJobs() []job {
+	cfg := app.config.cleanup
+	jobs := []job{
+		{
+			// 清理已经过期的各类Token
+			name:      "purge_expired_tokens",
+			interval:  cfg.interval,
+			exclusive: true,
+			run: func(now time.Time) (int64, error) {
+				var total int64
+				for _, purge := range []func(time.Time) (int64, error){
+					app.models.Token.DeleteExpired,
+					app.models.Denylist.DeleteExpired,
+					app.models.OAuth.DeleteExpired,
+					app.models.Identities.DeleteExpiredStates,
+					app.models.Lockout.DeleteExpired,
+				} {
+					deleted, err := purge(now)
+					if err != nil {
+						return total, err
+					}
+					total += deleted
+				}
+				return total, nil
+			},
+		},
+		{
+			// 清理已经发送与已经放弃的邮件
+			name:      "purge_sent_emails",
+			interval:  cfg.interval,
+			exclusive: true,
+			run: func(now time.Time) (int64, error) {
+				sent, err := app.models.Outbox.DeleteSent(now.Add(-outboxRetention))
+				if err != nil {
+					return sent, err
+				}
+				dead, err := app.models.Outbox.DeleteDead(now.Add(-outboxRetention))
+				return sent + dead, err
+			},
+		},
+		{
+			// 删除宽限期已经结束的账号
+			name:      "delete_scheduled_accounts",
+			interval:  cfg.interval,
+			exclusive: true,
+			run:       app.models.User.DeleteScheduled,
+		},
+	}
+	// 删除长期没有激活的账号
+	if cfg.unactivatedDays > 0 {
+		jobs = append(jobs, job{
+			name:      "delete_unactivated_accounts",
+			interval:  cfg.interval,
+			exclusive: true,
+			run: func(now time.Time) (int64, error) {
+				return app.models.User.DeleteUnactivated(now.AddDate(0, 0, -cfg.unactivatedDays))
+			},
+		})
+	}
+	// 彻底删除保留期已经结束的电影
+	if cfg.movieTrashDays > 0 {
+		jobs = append(jobs, job{
+			name:      "purge_deleted_movies",
+			interval:  cfg.interval,
+			exclusive: true,
+			run: func(now time.Time) (int64, error) {
+				return app.models.Movies.PurgeDeleted(now.AddDate(0, 0, -cfg.movieTrashDays))
+			},
+		})
+	}
+	// 多实例部署时其他实例撤销的Token最多延迟一个周期生效
+	if app.jwtKeys != nil {
+		jobs = append(jobs, job{
+			name:     "sync_denylist",
+			interval: 30 * time.Second,
+			run: func(time.Time) (int64, error) {
+				denylist, err := app.models.Denylist.GetAll()
+				if err != nil {
+					return 0, err
+				}
+				app.denylist.set(denylist)
+				return 0, nil
+			},
+		})
+	}
+	return jobs
+}
+
+// 为每个任务启动一个goroutine 服务器开始关闭时退出
+func (app *application) startScheduler(jobs []job) {
+	for _, j := range jobs {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			ticker := time.NewTicker(j.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-app.shutdown:
+					return
+				case <-ticker.C:
+					app.runJob(j)
+				}
+			}
+		}()
+	}
+}
+
+// 执行一次任务并记录结果
+func (app *application) runJob(j job) {
+	stats, ok := schedulerStats.Get(j.name).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map)
+		schedulerStats.Set(j.name, stats)
+	}
+	start := time.Now()
+	var (
+		affected int64
+		err      error
+	)
+	ran := true
+	if j.exclusive {
+		ran, err = app.models.Locks.TryRun("job:"+j.name, func() error {
+			var err error
+			affected, err = j.run(start)
+			return err
+		})
+	} else {
+		affected, err = j.run(start)
+	}
+	// 其他实例正在执行
+	if err == nil && !ran {
+		stats.Add("skipped", 1)
+		return
+	}
+	stats.Add("runs", 1)
+	if err != nil {
+		stats.Add("failures", 1)
+		app.logger.PrintError(err, map[string]string{"job": j.name})
+		return
+	}
+	stats.Add("affected", affected)
+	last := new(expvar.String)
+	last.Set(start.UTC().Format(time.RFC3339))
+	stats.Set("last_success", last)
+	if affected > 0 {
+		app.logger.PrintInfo("background job completed", map[string]string{
+			"job":      j.name,
+			"affected": fmt.Sprint(affected),
+			"duration": time.Since(start).String(),
+		})
+	}
+}
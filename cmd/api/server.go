@@ -50,6 +50,8 @@ func (app *application) server() error {
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		// 通知长期运行的后台任务退出
+		close(app.shutdown)
 		// 使用WaitGroup等待进行完成
 		app.wg.Wait()
 		// 将nil存入ShutdownErr
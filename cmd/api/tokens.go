@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/tomasen/realip"
 	"greenlight.vdebu.net/internal/data"
 	validator2 "greenlight.vdebu.net/internal/validator"
 	"net/http"
@@ -30,13 +31,23 @@ func (app *application) createAuthenticationTokenHandler(c *gin.Context) {
 		app.failedValidationResponse(c, v.Errors)
 		return
 	}
+	// 账号或IP因多次登录失败被锁定时直接拒绝 无需再验证密码
+	ip := realip.FromRequest(c.Request)
+	if app.loginLocked(c, input.Email, ip) {
+		return
+	}
 	// 尝试使用给定的信息从数据库提取用户
 	user, err := app.models.User.GetByEmail(input.Email)
 	if err != nil {
 		// 判断错误类型
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			// 输入的信息有误
+			// 输入的信息有误 不存在的邮箱同样计入失败次数
+			err = app.recordLoginFailure(input.Email, ip, nil)
+			if err != nil {
+				app.serverErrorResponse(c, err)
+				return
+			}
 			app.invalidCredentialResponse(c)
 		default:
 			app.serverErrorResponse(c, err)
@@ -52,17 +63,265 @@ func (app *application) createAuthenticationTokenHandler(c *gin.Context) {
 	}
 	// 没有发生错误再检查是否匹配成功
 	if !match {
+		// 记录失败的登录 达到阈值后锁定账号
+		err = app.recordLoginFailure(input.Email, ip, user)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
 		// 输入的信息无效
 		app.invalidCredentialResponse(c)
 		return
 	}
 	// 邮箱与密码都是匹配的则进行认证秘钥的生成
-	// 绑定当前用户的ID时限为一天作用域为认证
-	token, err := app.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	app.completeLogin(c, user)
+}
+
+// 用户通过了第一步认证(密码或外部身份)后完成登录
+// 开启了二次验证的账号还需要提供验证码 此时只返回mfa_pending Token
+func (app *application) completeLogin(c *gin.Context, user *data.User) {
+	userTOTP, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if userTOTP != nil && userTOTP.Confirmed {
+		// 返回短期有效的mfa_pending Token 用于在下一步中换取真正的认证Token
+		pendingToken, err := app.models.Token.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		app.writeJson(c, http.StatusAccepted, envelop{"mfa_required": true, "mfa_pending_token": pendingToken}, nil)
+		return
+	}
+	app.issueAuthenticationTokens(c, user)
+}
+
+// 为通过认证的用户生成短期的认证Token与长期的刷新Token并写入响应体
+func (app *application) issueAuthenticationTokens(c *gin.Context, user *data.User) {
+	// 完成全部认证步骤后才清除账号的失败记录 只通过了密码验证时不清除 否则错误的验证码永远不会触发锁定
+	err := app.models.Lockout.Reset(data.LockoutAccount, user.Email)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	token, refreshToken, err := app.models.Token.NewPair(user.ID, app.config.auth.accessTokenTTL, app.config.auth.refreshTokenTTL, c.Request.UserAgent(), realip.FromRequest(c.Request))
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 根据配置将认证Token签发为JWT
+	err = app.signAuthenticationToken(user, token)
 	if err != nil {
 		app.serverErrorResponse(c, err)
 		return
 	}
 	// 将生成的token信息返回给用户
-	app.writeJson(c, http.StatusCreated, envelop{"token": token}, nil)
+	app.writeJson(c, http.StatusCreated, envelop{"token": token, "refresh_token": refreshToken}, nil)
+}
+
+// 使用刷新Token换取新的认证Token 刷新Token在每次使用后都会被轮换
+func (app *application) createRefreshTokenHandler(c *gin.Context) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator2.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 轮换刷新Token
+	token, refreshToken, err := app.models.Token.Rotate(input.TokenPlaintext, app.config.auth.accessTokenTTL, app.config.auth.refreshTokenTTL, c.Request.UserAgent(), realip.FromRequest(c.Request))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(c)
+		case errors.Is(err, data.ErrTokenReused):
+			// 刷新Token被重复使用 整条链已经被撤销 记录下来便于排查
+			app.logger.PrintInfo("refresh token reuse detected, token family revoked", map[string]string{
+				"request_url": c.Request.URL.String(),
+			})
+			app.syncDenylist()
+			app.invalidRefreshTokenResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 签发JWT时需要完整的用户信息
+	if app.jwtKeys != nil {
+		user, err := app.models.User.Get(token.UserID)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+		err = app.signAuthenticationToken(user, token)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			return
+		}
+	}
+	app.writeJson(c, http.StatusCreated, envelop{"token": token, "refresh_token": refreshToken}, nil)
+}
+
+// 根据用户输入的邮箱生成用于重置密码的Token并通过邮件发送
+func (app *application) createPasswordResetTokenHandler(c *gin.Context) {
+	// 读取用户输入的邮箱
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	// 检查邮箱的基础有效性
+	v := validator2.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 无论邮箱是否已经注册都返回相同的响应 防止通过该接口探测已注册的邮箱
+	env := envelop{"message": "an email will be sent to you containing password reset instructions"}
+	// 尝试使用邮箱提取用户
+	user, err := app.models.User.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			// 查无此人直接返回统一的响应
+			app.writeJson(c, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 未激活的账号不允许重置密码 同样返回统一的响应
+	if !user.Activated {
+		app.writeJson(c, http.StatusAccepted, env, nil)
+		return
+	}
+	err = app.models.Transaction(func(tx data.Models) error {
+		// 生成45分钟有效的重置密码Token
+		token, err := tx.Token.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
+		// 由后台的发送者发送包含Token的邮件
+		emailData := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+		return app.queueEmail(tx.Outbox, user.Email, "token_password_reset.tmpl.html", emailData)
+	})
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusAccepted, env, nil)
+}
+
+// 为尚未激活的账号重新发送激活邮件
+func (app *application) createActivationTokenHandler(c *gin.Context) {
+	// 读取用户输入的邮箱
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator2.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 无论邮箱是否注册或账号是否已经激活都返回相同的响应 不暴露账号的状态
+	env := envelop{"message": "an email will be sent to you containing activation instructions"}
+	user, err := app.models.User.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.writeJson(c, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 已经激活的账号不需要再发送激活邮件
+	if user.Activated {
+		app.writeJson(c, http.StatusAccepted, env, nil)
+		return
+	}
+	err = app.models.Transaction(func(tx data.Models) error {
+		// 先撤销之前发送的所有激活Token 确保只有最新的Token有效
+		err := tx.Token.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			return err
+		}
+		// 生成新的三天有效的激活Token
+		token, err := tx.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+		// 由后台的发送者发送激活邮件
+		emailData := map[string]interface{}{
+			"activationToken": token.Plaintext,
+		}
+		return app.queueEmail(tx.Outbox, user.Email, "token_activation.tmpl.html", emailData)
+	})
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusAccepted, env, nil)
+}
+
+// 撤销当前请求使用的认证Token(登出) 同一条链上的刷新Token也会一并失效
+func (app *application) deleteAuthenticationTokenHandler(c *gin.Context) {
+	err := app.models.Token.Revoke(app.contextGetTokenHash(c))
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.syncDenylist()
+	app.writeJson(c, http.StatusOK, envelop{"message": "you have been successfully logged out"}, nil)
+}
+
+// 列出当前用户所有有效的会话
+func (app *application) listUserSessionsHandler(c *gin.Context) {
+	user := app.contextGetUser(c)
+	sessions, err := app.models.Token.GetSessionsForUser(user.ID, app.contextGetTokenHash(c))
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"sessions": sessions}, nil)
+}
+
+// 根据会话ID撤销当前用户的某个会话
+func (app *application) deleteUserSessionHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	user := app.contextGetUser(c)
+	err = app.models.Token.RevokeSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.syncDenylist()
+	app.writeJson(c, http.StatusOK, envelop{"message": "session successfully revoked"}, nil)
 }
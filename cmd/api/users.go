@@ -12,21 +12,35 @@ import (
 func (app *application) registerUserHandler(c *gin.Context) {
 	// 提取用户输入的数据
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		Invitation string `json:"invitation"` // 邀请注册模式下必须提供
 	}
 	err := app.readJSON(c, &input)
 	if err != nil {
 		app.badRequestResponse(c, err)
 		return
 	}
+	// 邀请注册模式下必须提供邀请码 开放注册时邀请码是可选的
+	var invitation *data.Invitation
+	if app.config.registration.mode == registrationInvite || input.Invitation != "" {
+		var ok bool
+		invitation, ok = app.readInvitation(c, input.Invitation, input.Email)
+		if !ok {
+			return
+		}
+	}
 	// 提取输入的信息
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false, // 默认状态处于未激活
 	}
+	// 邀请邮件已经证明了邮箱的所有权 无需再激活
+	if invitation != nil {
+		user.Activated = true
+	}
 	// 使用set方法进行密码的设置
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -41,8 +55,36 @@ func (app *application) registerUserHandler(c *gin.Context) {
 		app.failedValidationResponse(c, v.Errors)
 		return
 	}
-	// 数据准确尝试向数据库插入
-	err = app.models.User.Insert(user)
+	// 用户、权限、激活Token与欢迎邮件在同一个事务中写入 任何一步失败都不会留下无法激活的账号
+	err = app.models.Transaction(func(tx data.Models) error {
+		// 数据准确尝试向数据库插入
+		err := tx.User.Insert(user)
+		if err != nil {
+			return err
+		}
+		// 為新創建的賬號設置默認權限
+		err = tx.Permissions.AddForUser(user.ID, defaultUserPermissions...)
+		if err != nil {
+			return err
+		}
+		// 接受邀请并授予邀请中的角色与权限 不再发送激活邮件
+		if invitation != nil {
+			return tx.Invitations.Accept(invitation.ID, user.ID)
+		}
+		// 生成用于账号激活的Token
+		// 指定当前数据库生成的userID时效为三天范围仅限激活
+		token, err := tx.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+		// 使用字典存储要嵌入邮件的数据
+		emailData := map[string]interface{}{
+			"userID":          user.ID,         // 注册成功的用户ID
+			"activationToken": token.Plaintext, // 未哈希用于激活账号的Token
+		}
+		// 注册成功后向用户的邮箱发送欢迎邮件 由后台的发送者投递
+		return app.queueEmail(tx.Outbox, user.Email, "user_welcome.tmpl.html", emailData)
+	})
 	if err != nil {
 		// 判断错误类型
 		switch {
@@ -54,34 +96,6 @@ func (app *application) registerUserHandler(c *gin.Context) {
 		}
 		return
 	}
-	// 為新創建的賬號設置讀權限
-	err = app.models.Permissions.AddForUser(user.ID, "movie:read")
-	if err != nil {
-		app.serverErrorResponse(c, err)
-		return
-	}
-	// 生成用于账号激活的Token
-	// 指定当前数据库生成的userID时效为三天范围仅限激活
-	token, err := app.models.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(c, err)
-		return
-	}
-	app.background(func() {
-		// 使用字典存储要嵌入邮件的数据
-		emailData := map[string]interface{}{
-			"userID":          user.ID,         // 注册成功的用户ID
-			"activationToken": token.Plaintext, // 未哈希用于激活账号的Token
-		}
-		// 使用goroutine完成邮件的发送操作节省完成请求所需要的时间
-		// 注册成功后向用户的邮箱发送欢迎邮件
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl.html", emailData)
-		// 这里不能使用app.serverErrorResponse 因为在这之前服务器可能已经正确处理请求写入响应体
-		// 使用app.logger.PrintError输出错误信息
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
 	// 展示成功创建的信息
 	app.writeJson(c, http.StatusCreated, envelop{"user": user}, nil)
 }
@@ -144,3 +158,344 @@ func (app *application) activateUserHandler(c *gin.Context) {
 	// 输出新的用户信息
 	app.writeJson(c, http.StatusOK, envelop{"user": user}, nil)
 }
+
+// 使用重置密码的Token为用户设置新的密码
+func (app *application) updateUserPasswordHandler(c *gin.Context) {
+	// 读取新的密码与重置密码的Token
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	// 检查输入的有效性
+	v := validator2.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 查找Token对应的用户
+	user, err := app.models.User.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expiry password reset token")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 设置新的密码哈希
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 更新数据库中的用户信息(乐观锁)
+	err = app.models.User.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 密码修改成功后删除该用户所有的重置密码Token与认证Token 使已登录的会话全部失效
+	err = app.models.Token.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Token.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Token.DeleteAllForUser(data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.syncDenylist()
+	app.writeJson(c, http.StatusOK, envelop{"message": "your password was successfully reset"}, nil)
+}
+
+// 申请修改当前用户的邮箱 新邮箱需要通过邮件中的Token确认后才会生效
+func (app *application) updateUserEmailHandler(c *gin.Context) {
+	var input struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator2.New()
+	v.Check(input.Password != "", "password", "must be provided")
+	data.ValidateEmail(v, input.Email)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 重新查询完整的用户信息(JWT模式下context中的用户不包含密码哈希)
+	user, err := app.models.User.Get(app.contextGetUser(c).ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 修改邮箱前需要确认当前的密码
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	// 邮箱在数据库中不区分大小写 已经被使用(包括自己)的邮箱不能再申请
+	_, err = app.models.User.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email already exists")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Transaction(func(tx data.Models) error {
+		// 记录新的邮箱并使之前发出的确认Token失效
+		err := tx.EmailChanges.Set(user.ID, input.Email)
+		if err != nil {
+			return err
+		}
+		err = tx.Token.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+		token, err := tx.Token.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			return err
+		}
+		// 向新邮箱发送确认Token 同时通知原邮箱
+		err = app.queueEmail(tx.Outbox, input.Email, "email_change_confirm.tmpl.html", map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			return err
+		}
+		return app.queueEmail(tx.Outbox, user.Email, "email_change_notice.tmpl.html", map[string]interface{}{
+			"newEmail": input.Email,
+		})
+	})
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	env := envelop{"message": "an email will be sent to the new address containing confirmation instructions"}
+	app.writeJson(c, http.StatusAccepted, env, nil)
+}
+
+// 使用邮件中的Token确认新的邮箱
+func (app *application) confirmUserEmailHandler(c *gin.Context) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator2.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user, err := app.models.User.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expiry email change token")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	newEmail, err := app.models.EmailChanges.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expiry email change token")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	user.Email = newEmail
+	err = app.models.User.Update(user)
+	if err != nil {
+		switch {
+		// 申请之后邮箱可能已经被其他账号注册
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email already exists")
+			app.failedValidationResponse(c, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 修改完成后清理修改记录与使用过的Token
+	err = app.models.EmailChanges.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Token.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"user": user}, nil)
+}
+
+// 返回当前用户的信息
+func (app *application) showCurrentUserHandler(c *gin.Context) {
+	// JWT模式下context中的用户只包含声明中的字段 需要重新查询完整的信息
+	user, err := app.models.User.Get(app.contextGetUser(c).ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"user": user}, nil)
+}
+
+// 部分更新当前用户的名称与资料
+func (app *application) updateCurrentUserHandler(c *gin.Context) {
+	user, err := app.models.User.Get(app.contextGetUser(c).ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	// 使用指针区分未提供的字段与空值
+	var input struct {
+		Name        *string `json:"name"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		Locale      *string `json:"locale"`
+		Timezone    *string `json:"timezone"`
+	}
+	err = app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.DisplayName != nil {
+		user.DisplayName = *input.DisplayName
+	}
+	if input.Bio != nil {
+		user.Bio = *input.Bio
+	}
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+	}
+	if input.Timezone != nil {
+		user.Timezone = *input.Timezone
+	}
+	v := validator2.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.User.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"user": user}, nil)
+}
+
+// 使用当前的密码为当前用户设置新的密码
+func (app *application) updateCurrentUserPasswordHandler(c *gin.Context) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator2.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	user, err := app.models.User.Get(app.contextGetUser(c).ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.User.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	// 保留当前会话 撤销其他所有会话与尚未使用的重置密码Token
+	err = app.models.Token.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	err = app.models.Token.RevokeOtherSessions(user.ID, app.contextGetTokenHash(c))
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.syncDenylist()
+	app.writeJson(c, http.StatusOK, envelop{"message": "your password was successfully updated"}, nil)
+}
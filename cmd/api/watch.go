@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"greenlight.vdebu.net/internal/data"
+	"greenlight.vdebu.net/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 列出当前用户的想看列表 支持分页与排序
+func (app *application) listWatchlistHandler(c *gin.Context) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// 默认最近加入的在前
+	input.Filters.Sort = app.readString(qs, "sort", "-added_at")
+	input.SortSafeList = []string{"added_at", "title", "year", "rating", "-added_at", "-title", "-year", "-rating"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	entries, metaData, err := app.models.Watch.GetWatchlist(app.contextGetUser(c).ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"watchlist": entries, "metadata": metaData}, nil)
+}
+
+// 将电影加入当前用户的想看列表 重复加入不会产生错误
+func (app *application) addToWatchlistHandler(c *gin.Context) {
+	var input struct {
+		MovieID int64 `json:"movie_id"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.MovieID > 0, "movie_id", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	addedAt, err := app.models.Watch.AddToWatchlist(app.contextGetUser(c).ID, input.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	env := envelop{"movie_id": input.MovieID, "added_at": addedAt}
+	app.writeJson(c, http.StatusCreated, env, nil)
+}
+
+// 将电影从当前用户的想看列表中移除 路由参数为电影的ID
+func (app *application) removeFromWatchlistHandler(c *gin.Context) {
+	movieID, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Watch.RemoveFromWatchlist(app.contextGetUser(c).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "movie successfully removed from watchlist"}, nil)
+}
+
+// 列出当前用户的观看记录 支持分页与排序
+func (app *application) listHistoryHandler(c *gin.Context) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := c.Request.URL.Query()
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// 默认最近观看的在前
+	input.Filters.Sort = app.readString(qs, "sort", "-watched_at")
+	input.SortSafeList = []string{"watched_at", "title", "year", "-watched_at", "-title", "-year"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	entries, metaData, err := app.models.Watch.GetHistory(app.contextGetUser(c).ID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"history": entries, "metadata": metaData}, nil)
+}
+
+// 为当前用户添加一条观看记录 未提供观看时间时使用当前时间
+func (app *application) addToHistoryHandler(c *gin.Context) {
+	var input struct {
+		MovieID   int64      `json:"movie_id"`
+		WatchedAt *time.Time `json:"watched_at"`
+		Rating    *int32     `json:"rating"`
+	}
+	err := app.readJSON(c, &input)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	entry := &data.HistoryEntry{
+		UserID:    app.contextGetUser(c).ID,
+		MovieID:   input.MovieID,
+		WatchedAt: time.Now(),
+		Rating:    input.Rating,
+	}
+	if input.WatchedAt != nil {
+		entry.WatchedAt = *input.WatchedAt
+	}
+	v := validator.New()
+	if data.ValidateHistoryEntry(v, entry); !v.Valid() {
+		app.failedValidationResponse(c, v.Errors)
+		return
+	}
+	err = app.models.Watch.AddToHistory(entry)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "does not exist")
+			app.failedValidationResponse(c, v.Errors)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	env := envelop{"entry": envelop{
+		"id":         entry.ID,
+		"movie_id":   entry.MovieID,
+		"watched_at": entry.WatchedAt,
+		"rating":     entry.Rating,
+	}}
+	app.writeJson(c, http.StatusCreated, env, nil)
+}
+
+// 删除当前用户的一条观看记录
+func (app *application) deleteFromHistoryHandler(c *gin.Context) {
+	id, err := app.readIDParam(c)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	err = app.models.Watch.DeleteFromHistory(app.contextGetUser(c).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(c)
+		default:
+			app.serverErrorResponse(c, err)
+		}
+		return
+	}
+	app.writeJson(c, http.StatusOK, envelop{"message": "history entry successfully deleted"}, nil)
+}
+
+// 以CSV附件导出当前用户所有的观看记录 按观看时间排列 方便导入其他服务或表格
+func (app *application) exportHistoryHandler(c *gin.Context) {
+	userID := app.contextGetUser(c).ID
+	entries, err := app.models.Watch.GetAllHistory(userID)
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="cinelight-history-%d.csv"`, userID))
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"watched_at", "movie_id", "title", "year", "rating"})
+	for _, entry := range entries {
+		rating := ""
+		if entry.Rating != nil {
+			rating = strconv.Itoa(int(*entry.Rating))
+		}
+		_ = w.Write([]string{
+			entry.WatchedAt.UTC().Format(time.RFC3339),
+			strconv.FormatInt(entry.Movie.ID, 10),
+			entry.Movie.Title,
+			strconv.Itoa(int(entry.Movie.Year)),
+			rating,
+		})
+	}
+	// 响应头已经发送 写入失败时只能记录错误
+	w.Flush()
+	if err := w.Error(); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
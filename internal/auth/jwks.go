@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWKS中的一个公钥 只包含验证签名需要的字段
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC与OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// IdP通过jwks_uri公开的公钥集合
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// 将JWK转换为Go的公钥类型 不支持的类型返回错误
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// 使用公钥验证JWS签名 alg必须与公钥的类型匹配 防止算法混淆攻击
+func verifySignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	switch alg {
+	case "RS256", "RS384", "RS512":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidIDToken
+		}
+		hash, digest := hashFor(alg, signingInput)
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return ErrInvalidIDToken
+		}
+	case "ES256", "ES384":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrInvalidIDToken
+		}
+		// JWS中的ECDSA签名是定长的r||s 而不是ASN.1编码
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidIDToken
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		_, digest := hashFor(alg, signingInput)
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidIDToken
+		}
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signingInput, signature) {
+			return ErrInvalidIDToken
+		}
+	default:
+		// 包括"none"在内的其他算法一律拒绝
+		return ErrInvalidIDToken
+	}
+	return nil
+}
+
+// 根据算法计算签名输入的摘要
+func hashFor(alg string, input []byte) (crypto.Hash, []byte) {
+	switch alg[2:] {
+	case "384":
+		sum := sha512.Sum384(input)
+		return crypto.SHA384, sum[:]
+	case "512":
+		sum := sha512.Sum512(input)
+		return crypto.SHA512, sum[:]
+	default:
+		sum := sha256.Sum256(input)
+		return crypto.SHA256, sum[:]
+	}
+}
+
+// 从JSON中解析公钥集合 无法识别的公钥会被忽略
+func parseJWKS(body []byte) (map[string]crypto.PublicKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		// 只使用用于签名的公钥
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
@@ -0,0 +1,318 @@
+// Package auth 实现OpenID Connect的授权码流程(PKCE) 用于使用外部身份提供方(IdP)登录
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ID Token验证失败时返回的错误 调用方不需要区分具体原因
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// 允许IdP与本机之间存在的时钟误差
+const clockSkew = time.Minute
+
+// 身份提供方的配置
+type Config struct {
+	Name         string   // 在路由中使用的名称 例如/v1/auth/<name>/login
+	Issuer       string   // IdP的issuer 用于服务发现与验证ID Token
+	ClientID     string   // 在IdP注册的客户端ID
+	ClientSecret string   // 客户端秘钥 公共客户端可以为空
+	RedirectURL  string   // 回调地址 必须与IdP中注册的一致
+	Scopes       []string // 额外请求的scope openid总是会被请求
+}
+
+// IdP服务发现文档中需要的字段
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// 从ID Token中读取的用户信息
+type IDClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	AuthorizedBy  string   `json:"azp"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// aud既可以是字符串也可以是字符串数组
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// 一个外部身份提供方 服务发现与公钥在第一次使用时获取并缓存
+type Provider struct {
+	config Config
+	// 用于访问IdP的HTTP客户端与当前时间 可以替换为测试用的实现
+	Client *http.Client
+	Now    func() time.Time
+
+	mu            sync.Mutex
+	discovery     *discovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// 创建新的身份提供方 不会立即访问IdP
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("oidc provider requires name, issuer, client id and redirect url")
+	}
+	return &Provider{
+		config: cfg,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Now:    time.Now,
+	}, nil
+}
+
+// 提供方的名称
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// 获取服务发现文档 成功后缓存 失败时下一次调用会重试
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	body, err := p.get(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	var d discovery
+	if err = json.Unmarshal(body, &d); err != nil {
+		return nil, err
+	}
+	// 文档中的issuer必须与配置完全一致 防止被其他IdP冒充
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: expected %q, got %q", p.config.Issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document is missing required endpoints")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// 生成跳转到IdP的授权地址
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.config.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(codeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// 使用授权码换取ID Token并完成验证
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// 机密客户端使用client_secret_basic进行认证
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	body, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, err
+	}
+	if tokenResponse.IDToken == "" {
+		return nil, errors.New("oidc token response is missing id_token")
+	}
+	return p.VerifyIDToken(ctx, tokenResponse.IDToken, nonce)
+}
+
+// 验证ID Token的签名、issuer、audience、有效期与nonce
+func (p *Provider) VerifyIDToken(ctx context.Context, token, nonce string) (*IDClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(h, &hdr); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	key, err := p.publicKey(ctx, d.JWKSURI, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	if err = verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var claims IDClaims
+	if err = json.Unmarshal(c, &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	// 签名有效后再检查声明
+	now := p.Now()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, ErrInvalidIDToken
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, ErrInvalidIDToken
+	// 存在多个audience时azp必须是当前客户端
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, ErrInvalidIDToken
+	case claims.Subject == "":
+		return nil, ErrInvalidIDToken
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)):
+		return nil, ErrInvalidIDToken
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, ErrInvalidIDToken
+	case claims.Nonce != nonce:
+		return nil, ErrInvalidIDToken
+	}
+	return &claims, nil
+}
+
+// 检查audience中是否包含给定的客户端
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据kid查找IdP的公钥 找不到时重新获取JWKS 以支持IdP的秘钥轮换
+// 为了避免伪造的kid导致频繁请求IdP 每分钟最多重新获取一次
+func (p *Provider) publicKey(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && p.Now().Sub(p.keysFetchedAt) < time.Minute {
+		return nil, ErrInvalidIDToken
+	}
+	body, err := p.get(ctx, jwksURI)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetchedAt = p.Now()
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+	return key, nil
+}
+
+// 发送GET请求并读取JSON响应体
+func (p *Provider) get(ctx context.Context, target string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.do(req)
+}
+
+// 发送请求 非2xx的响应视为错误
+func (p *Provider) do(req *http.Request) ([]byte, error) {
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// 限制响应体的大小
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("oidc: %s %s returned %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return body, nil
+}
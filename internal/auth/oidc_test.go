@@ -0,0 +1,371 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "cinelight"
+	testClientSecret = "secret"
+	testNonce        = "nonce-123"
+)
+
+// 测试使用的固定时间
+var testNow = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// 用于签名ID Token的秘钥
+type testKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+// 本地的IdP替身 提供服务发现、JWKS与token端点
+type testIdP struct {
+	*httptest.Server
+	mu        sync.Mutex
+	keys      []testKey // 通过JWKS公开的公钥
+	jwksHits  int       // JWKS被请求的次数
+	idToken   string    // token端点返回的ID Token
+	verifier  string    // token端点期望的code_verifier
+	tokenForm url.Values
+}
+
+func newTestIdP(t *testing.T, keys ...testKey) *testIdP {
+	t.Helper()
+	idp := &testIdP{keys: keys}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		idp.jwksHits++
+		set := jsonWebKeySet{}
+		for _, k := range idp.keys {
+			set.Keys = append(set.Keys, publicJWK(k))
+		}
+		writeTestJSON(w, set)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		idp.tokenForm = r.PostForm
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != testClientID || pass != testClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.PostForm.Get("code_verifier") != idp.verifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		writeTestJSON(w, map[string]string{"id_token": idp.idToken, "token_type": "Bearer"})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// 创建指向IdP替身的提供方 使用固定的时钟
+func (idp *testIdP) provider(t *testing.T, now *time.Time) *Provider {
+	t.Helper()
+	p, err := NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "http://localhost/v1/auth/test/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Client = idp.Client()
+	p.Now = func() time.Time { return *now }
+	return p
+}
+
+func (idp *testIdP) setKeys(keys ...testKey) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys = keys
+}
+
+func (idp *testIdP) hits() int {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.jwksHits
+}
+
+// 默认有效的ID Token声明
+func (idp *testIdP) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            idp.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            testNow.Add(time.Hour).Unix(),
+		"iat":            testNow.Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func newRSAKey(t *testing.T, kid string) testKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, alg: "RS256", key: key}
+}
+
+func newEd25519Key(t *testing.T, kid string) testKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, alg: "EdDSA", key: key}
+}
+
+// 将公钥转换为JWK
+func publicJWK(k testKey) jsonWebKey {
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{
+			Kty: "RSA", Kid: k.kid, Use: "sig", Alg: k.alg,
+			N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return jsonWebKey{Kty: "OKP", Kid: k.kid, Use: "sig", Alg: k.alg, Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)}
+	default:
+		panic("unsupported test key")
+	}
+}
+
+// 使用秘钥签名ID Token
+func signTestToken(t *testing.T, k testKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch k.alg {
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = k.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case "EdDSA":
+		signature, err = k.key.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestExchange(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	idp := newTestIdP(t, key)
+	now := testNow
+	p := idp.provider(t, &now)
+
+	verifier, err := RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.verifier = verifier
+	idp.idToken = signTestToken(t, key, idp.claims())
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state-1", testNonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge") != CodeChallenge(verifier) || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorization url is missing the PKCE challenge: %s", authURL)
+	}
+	if q.Get("nonce") != testNonce || q.Get("state") != "state-1" {
+		t.Errorf("authorization url is missing state or nonce: %s", authURL)
+	}
+
+	claims, err := p.Exchange(context.Background(), "code-1", verifier, testNonce)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+	if got := idp.tokenForm.Get("code"); got != "code-1" {
+		t.Errorf("token endpoint received code %q", got)
+	}
+
+	// 错误的code_verifier会被IdP拒绝
+	if _, err := p.Exchange(context.Background(), "code-1", "wrong-verifier", testNonce); err == nil {
+		t.Error("Exchange with wrong code_verifier succeeded")
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	other := newRSAKey(t, "k1") // 与公开的公钥使用相同的kid但秘钥不同
+	idp := newTestIdP(t, key)
+
+	tests := []struct {
+		name   string
+		key    testKey
+		modify func(claims map[string]interface{})
+		nonce  string
+	}{
+		{name: "bad signature", key: other},
+		{name: "wrong audience", key: key, modify: func(c map[string]interface{}) { c["aud"] = "someone-else" }},
+		{name: "multiple audiences without azp", key: key, modify: func(c map[string]interface{}) { c["aud"] = []string{testClientID, "other"} }},
+		{name: "wrong issuer", key: key, modify: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", key: key, modify: func(c map[string]interface{}) { c["exp"] = testNow.Add(-2 * time.Minute).Unix() }},
+		{name: "issued in the future", key: key, modify: func(c map[string]interface{}) { c["iat"] = testNow.Add(time.Hour).Unix() }},
+		{name: "missing subject", key: key, modify: func(c map[string]interface{}) { delete(c, "sub") }},
+		{name: "nonce mismatch", key: key, nonce: "another-nonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := testNow
+			p := idp.provider(t, &now)
+			claims := idp.claims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			nonce := testNonce
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+			_, err := p.VerifyIDToken(context.Background(), signTestToken(t, tt.key, claims), nonce)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("expected ErrInvalidIDToken, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenAllowsClockSkew(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	idp := newTestIdP(t, key)
+	now := testNow
+	p := idp.provider(t, &now)
+	claims := idp.claims()
+	// 过期不到允许的误差范围内仍然有效
+	claims["exp"] = testNow.Add(-30 * time.Second).Unix()
+	if _, err := p.VerifyIDToken(context.Background(), signTestToken(t, key, claims), testNonce); err != nil {
+		t.Errorf("token within clock skew rejected: %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsNoneAlgorithm(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	idp := newTestIdP(t, key)
+	now := testNow
+	p := idp.provider(t, &now)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`))
+	payload, err := json.Marshal(idp.claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	if _, err := p.VerifyIDToken(context.Background(), token, testNonce); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expected ErrInvalidIDToken, got %v", err)
+	}
+}
+
+func TestVerifyIDTokenRefetchesJWKSForUnknownKid(t *testing.T) {
+	oldKey := newRSAKey(t, "k1")
+	newKey := newEd25519Key(t, "k2")
+	idp := newTestIdP(t, oldKey)
+	now := testNow
+	p := idp.provider(t, &now)
+
+	if _, err := p.VerifyIDToken(context.Background(), signTestToken(t, oldKey, idp.claims()), testNonce); err != nil {
+		t.Fatalf("initial token rejected: %v", err)
+	}
+	if hits := idp.hits(); hits != 1 {
+		t.Fatalf("expected 1 JWKS fetch, got %d", hits)
+	}
+
+	// IdP轮换秘钥 一分钟之内未知的kid不会触发重新获取
+	idp.setKeys(oldKey, newKey)
+	rotated := signTestToken(t, newKey, idp.claims())
+	if _, err := p.VerifyIDToken(context.Background(), rotated, testNonce); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("expected ErrInvalidIDToken within refetch interval, got %v", err)
+	}
+	if hits := idp.hits(); hits != 1 {
+		t.Errorf("JWKS refetched within a minute: %d fetches", hits)
+	}
+
+	// 超过一分钟后未知的kid会重新获取JWKS
+	now = now.Add(2 * time.Minute)
+	claims := idp.claims()
+	claims["iat"] = now.Unix()
+	if _, err := p.VerifyIDToken(context.Background(), signTestToken(t, newKey, claims), testNonce); err != nil {
+		t.Fatalf("token signed with rotated key rejected: %v", err)
+	}
+	if hits := idp.hits(); hits != 2 {
+		t.Errorf("expected 2 JWKS fetches, got %d", hits)
+	}
+	// 已知的kid直接使用缓存
+	if _, err := p.VerifyIDToken(context.Background(), signTestToken(t, oldKey, claims), testNonce); err != nil {
+		t.Fatalf("token signed with old key rejected: %v", err)
+	}
+	if hits := idp.hits(); hits != 2 {
+		t.Errorf("cached key caused a JWKS fetch: %d fetches", hits)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newTestIdP(t, newEd25519Key(t, "k1"))
+	now := testNow
+	p := idp.provider(t, &now)
+	// 配置的issuer与发现文档中的不一致
+	p.config.Issuer = idp.URL + "/"
+	if _, err := p.AuthCodeURL(context.Background(), "state", testNonce, "verifier"); err == nil {
+		t.Error("expected an issuer mismatch error")
+	}
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// 生成URL安全的随机字符串 用于state、nonce与PKCE的code_verifier
+func RandomString() (string, error) {
+	// 32字节编码后为43个字符 满足RFC 7636对code_verifier长度(43-128)的要求
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// 根据code_verifier计算S256方式的code_challenge
+func CodeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,196 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// API秘钥的固定前缀 方便在日志或代码仓库中识别泄露的秘钥
+const apiKeyPrefix = "cl_"
+
+// 服务账号使用的长期API秘钥 明文只会在创建时返回一次
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Expiry      *time.Time  `json:"expiry"` // 为nil时永不过期
+}
+
+// 解耦数据库连接池
+type APIKeyModel struct {
+	db dbtx
+}
+
+// 生成新的API秘钥 格式为 cl_<prefix>.<secret>
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	randomBytes := make([]byte, 21)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key := &APIKey{
+		Name:        name,
+		UserID:      userID,
+		Permissions: permissions,
+		Expiry:      expiry,
+		// 前8个字符作为可以公开展示的前缀
+		Prefix: apiKeyPrefix + encoded[:8],
+	}
+	key.Plaintext = key.Prefix + "." + encoded[8:]
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+	return key, nil
+}
+
+// 检查创建API秘钥时输入的信息
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// 检查API秘钥明文的基础格式
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(strings.HasPrefix(keyPlaintext, apiKeyPrefix), "key", "must be a valid api key")
+	v.Check(len(keyPlaintext) == 38, "key", "must be 38 bytes long")
+}
+
+// 创建新的API秘钥并写入数据库
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(key)
+	return key, err
+}
+
+// 向数据库中插入新的API秘钥
+func (m APIKeyModel) Insert(key *APIKey) error {
+	stmt := `
+			INSERT INTO api_keys(user_id,name,prefix,hash,permissions,expiry)
+			VALUES ($1,$2,$3,$4,$5,$6)
+			RETURNING id,created_at`
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array([]string(key.Permissions)), key.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// 列出用户所有的API秘钥(不包含明文)
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	stmt := `
+			SELECT id,name,prefix,permissions,created_at,last_used_at,expiry
+			FROM api_keys
+			WHERE user_id = $1
+			ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+		err = rows.Scan(
+			&key.ID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array((*[]string)(&key.Permissions)),
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// 删除用户的某个API秘钥
+func (m APIKeyModel) Delete(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 删除用户所有的API秘钥
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1`, userID)
+	return err
+}
+
+// 使用API秘钥查询其所属的用户与秘钥被授予的权限 同时更新秘钥的最后使用时间
+func (m APIKeyModel) GetForKey(keyPlaintext string) (*User, Permissions, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+	stmt := `
+			WITH key AS (
+				UPDATE api_keys
+				SET last_used_at = NOW()
+				WHERE hash = $1 AND (expiry IS NULL OR expiry > $2)
+				RETURNING user_id,permissions
+			)
+			SELECT ` + userColumns + `,key.permissions
+			FROM users
+			INNER JOIN key ON users.id = key.user_id`
+	var (
+		user        User
+		permissions Permissions
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, keyHash[:], time.Now()).Scan(
+		append(user.scanFields(), pq.Array((*[]string)(&permissions)))...,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &user, permissions, nil
+}
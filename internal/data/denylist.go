@@ -0,0 +1,62 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// 已撤销的认证Token的哈希 -> 过期时间
+type Denylist map[string]time.Time
+
+// 检查Token的哈希是否已经被撤销
+func (d Denylist) Include(hash []byte) bool {
+	_, ok := d[string(hash)]
+	return ok
+}
+
+// 解耦数据库连接池
+type DenylistModel struct {
+	db dbtx
+}
+
+// 读取所有尚未过期的已撤销Token
+func (m DenylistModel) GetAll() (Denylist, error) {
+	stmt := `
+			SELECT hash,expiry
+			FROM token_denylist
+			WHERE expiry > $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	denylist := make(Denylist)
+	for rows.Next() {
+		var (
+			hash   []byte
+			expiry time.Time
+		)
+		err = rows.Scan(&hash, &expiry)
+		if err != nil {
+			return nil, err
+		}
+		denylist[string(hash)] = expiry
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return denylist, nil
+}
+
+// 清理已经过期的记录 过期的Token本身就会被拒绝 返回删除的数量
+func (m DenylistModel) DeleteExpired(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM token_denylist WHERE expiry <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
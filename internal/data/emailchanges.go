@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 解耦数据库连接池
+type EmailChangeModel struct {
+	db dbtx
+}
+
+// 记录用户想要修改成的新邮箱 覆盖之前尚未确认的修改
+func (m EmailChangeModel) Set(userID int64, newEmail string) error {
+	stmt := `
+			INSERT INTO email_changes(user_id,new_email)
+			VALUES ($1,$2)
+			ON CONFLICT (user_id) DO UPDATE
+			SET new_email = EXCLUDED.new_email, created_at = NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, newEmail)
+	return err
+}
+
+// 获取用户尚未确认的新邮箱
+func (m EmailChangeModel) Get(userID int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var newEmail string
+	err := m.db.QueryRowContext(ctx, `SELECT new_email FROM email_changes WHERE user_id = $1`, userID).Scan(&newEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return newEmail, nil
+}
+
+// 删除用户尚未确认的修改
+func (m EmailChangeModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, `DELETE FROM email_changes WHERE user_id = $1`, userID)
+	return err
+}
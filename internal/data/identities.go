@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 与本地用户关联的外部身份
+type Identity struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"` // IdP中用户的唯一标识(sub)
+	Email     string    `json:"email"`
+}
+
+// 进行中的OIDC登录
+type OIDCState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+}
+
+// 解耦数据库连接池
+type IdentityModel struct {
+	db dbtx
+}
+
+// 关联外部身份与本地用户
+func (m IdentityModel) Insert(identity *Identity) error {
+	stmt := `
+			INSERT INTO user_identities(user_id,provider,subject,email)
+			VALUES ($1,$2,$3,$4)
+			RETURNING id,created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, identity.UserID, identity.Provider, identity.Subject, identity.Email).Scan(&identity.ID, &identity.CreatedAt)
+}
+
+// 查询外部身份关联的本地用户
+func (m IdentityModel) GetUser(provider, subject string) (*User, error) {
+	stmt := `
+			SELECT ` + userColumns + `
+			FROM users
+			INNER JOIN user_identities ON user_identities.user_id = users.id
+			WHERE user_identities.provider = $1 AND user_identities.subject = $2`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, provider, subject).Scan(user.scanFields()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// 列出用户关联的所有外部身份
+func (m IdentityModel) GetAllForUser(userID int64) ([]*Identity, error) {
+	stmt := `
+			SELECT id,created_at,provider,subject,email
+			FROM user_identities
+			WHERE user_id = $1
+			ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := []*Identity{}
+	for rows.Next() {
+		identity := Identity{UserID: userID}
+		err = rows.Scan(&identity.ID, &identity.CreatedAt, &identity.Provider, &identity.Subject, &identity.Email)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// 保存进行中的OIDC登录 数据库中只存储state的哈希
+func (m IdentityModel) InsertState(statePlaintext string, state *OIDCState, ttl time.Duration) error {
+	hash := sha256.Sum256([]byte(statePlaintext))
+	stmt := `
+			INSERT INTO oidc_states(hash,provider,code_verifier,nonce,expiry)
+			VALUES ($1,$2,$3,$4,$5)`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, hash[:], state.Provider, state.CodeVerifier, state.Nonce, time.Now().Add(ttl))
+	return err
+}
+
+// 取出并删除进行中的OIDC登录 每个state只能使用一次 同时清理已经过期的记录
+func (m IdentityModel) ConsumeState(statePlaintext, provider string) (*OIDCState, error) {
+	hash := sha256.Sum256([]byte(statePlaintext))
+	stmt := `
+			WITH expired AS (
+				DELETE FROM oidc_states WHERE expiry <= $3
+			)
+			DELETE FROM oidc_states
+			WHERE hash = $1 AND provider = $2 AND expiry > $3
+			RETURNING provider,code_verifier,nonce`
+	var state OIDCState
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, hash[:], provider, time.Now()).Scan(&state.Provider, &state.CodeVerifier, &state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &state, nil
+}
+
+// 删除所有已经过期且未被使用的登录状态 返回删除的数量
+func (m IdentityModel) DeleteExpiredStates(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"time"
+)
+
+// 管理员发出的注册邀请 明文只会通过邮件发送给被邀请者
+type Invitation struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+	Email       string      `json:"email"`
+	InvitedBy   *int64      `json:"invited_by"` // 邀请者的账号被删除后为nil
+	Role        *string     `json:"role"`       // 注册后分配的角色 可以为空
+	Permissions Permissions `json:"permissions"`
+	Expiry      time.Time   `json:"expiry"`
+}
+
+// 解耦数据库连接池
+type InvitationModel struct {
+	db dbtx
+}
+
+// 检查创建邀请时输入的信息
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// 检查注册时提供的邀请码的基础格式
+func ValidateInvitationPlaintext(v *validator.Validator, invitationPlaintext string) {
+	v.Check(invitationPlaintext != "", "invitation", "must be provided")
+	v.Check(len(invitationPlaintext) == 26, "invitation", "must be 26 bytes long")
+}
+
+// 创建新的邀请并写入数据库 角色不存在时邀请中不包含角色
+func (m InvitationModel) New(invitation *Invitation, ttl time.Duration) error {
+	// 与Token相同 使用16字节的随机数据生成邀请码
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	invitation.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(invitation.Plaintext))
+	invitation.Hash = hash[:]
+	invitation.Expiry = time.Now().Add(ttl)
+	if invitation.Permissions == nil {
+		invitation.Permissions = Permissions{}
+	}
+	stmt := `
+			INSERT INTO invitations(hash,email,invited_by,role_id,permissions,expiry)
+			VALUES ($1,$2,$3,(SELECT id FROM roles WHERE name = $4),$5,$6)
+			RETURNING id,created_at`
+	args := []interface{}{
+		invitation.Hash,
+		invitation.Email,
+		invitation.InvitedBy,
+		invitation.Role,
+		pq.Array([]string(invitation.Permissions)),
+		invitation.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// 查询邀请时使用的语句 之后拼接查询条件
+const selectInvitations = `
+			SELECT invitations.id,invitations.created_at,invitations.email,invitations.invited_by,
+			       roles.name,invitations.permissions,invitations.expiry
+			FROM invitations
+			LEFT JOIN roles ON roles.id = invitations.role_id`
+
+// 从数据库的一行中读取邀请
+func scanInvitation(row interface{ Scan(...interface{}) error }) (*Invitation, error) {
+	var invitation Invitation
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.Email,
+		&invitation.InvitedBy,
+		&invitation.Role,
+		pq.Array((*[]string)(&invitation.Permissions)),
+		&invitation.Expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// 列出所有尚未被接受且没有过期的邀请
+func (m InvitationModel) GetAllPending() ([]*Invitation, error) {
+	stmt := selectInvitations + `
+			WHERE invitations.accepted_at IS NULL AND invitations.expiry > $1
+			ORDER BY invitations.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []*Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// 使用邀请码查询尚未被接受且没有过期的邀请
+func (m InvitationModel) GetForPlaintext(invitationPlaintext string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(invitationPlaintext))
+	stmt := selectInvitations + `
+			WHERE invitations.hash = $1 AND invitations.accepted_at IS NULL AND invitations.expiry > $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	invitation, err := scanInvitation(m.db.QueryRowContext(ctx, stmt, hash[:], time.Now()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return invitation, nil
+}
+
+// 将邀请标记为已被userID代表的用户接受 同时授予邀请中的角色与权限
+// 变更以邀请者的名义写入审计表 邀请已经被接受时返回ErrRecordNotFound
+func (m InvitationModel) Accept(invitationID, userID int64) error {
+	stmt := `
+			WITH accepted AS (
+				UPDATE invitations
+				SET accepted_at = NOW(), user_id = $2
+				WHERE id = $1 AND accepted_at IS NULL
+				RETURNING invited_by,role_id,permissions
+			), granted AS (
+				INSERT INTO users_permissions
+				SELECT $2,permissions.id
+				FROM permissions,accepted
+				WHERE permissions.code = ANY(accepted.permissions)
+				ON CONFLICT DO NOTHING
+				RETURNING permission_id
+			), added AS (
+				INSERT INTO user_roles
+				SELECT $2,accepted.role_id
+				FROM accepted
+				WHERE accepted.role_id IS NOT NULL
+				ON CONFLICT DO NOTHING
+				RETURNING role_id
+			), audited AS (
+				INSERT INTO permissions_audit(actor_id,user_id,permission,action)
+				SELECT accepted.invited_by,$2,permissions.code,'grant'
+				FROM granted
+				INNER JOIN permissions ON permissions.id = granted.permission_id
+				CROSS JOIN accepted
+				UNION ALL
+				SELECT accepted.invited_by,$2,'role:' || roles.name,'grant'
+				FROM added
+				INNER JOIN roles ON roles.id = added.role_id
+				CROSS JOIN accepted
+			)
+			SELECT count(*) FROM accepted`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var rowsAffected int64
+	err := m.db.QueryRowContext(ctx, stmt, invitationID, userID).Scan(&rowsAffected)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 撤销尚未被接受的邀请
+func (m InvitationModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM invitations WHERE id = $1 AND accepted_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
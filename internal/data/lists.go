@@ -0,0 +1,470 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"time"
+)
+
+// 片单的可见性
+const (
+	ListPrivate  = "private"  // 只有创建者可见
+	ListUnlisted = "unlisted" // 持有分享链接即可查看 不会出现在公开的片单列表中
+	ListPublic   = "public"   // 任何人都可以查看
+)
+
+// 允许的可见性
+var ListVisibilities = []string{ListPrivate, ListUnlisted, ListPublic}
+
+var (
+	// 电影已经在片单中
+	ErrDuplicateListItem = errors.New("duplicate list item")
+	// 加入片单的电影不存在
+	ErrUnknownMovie = errors.New("unknown movie")
+	// 调整顺序时提交的电影与片单中的电影不一致
+	ErrListItemsMismatch = errors.New("list items mismatch")
+)
+
+// 用户整理的电影片单
+type List struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	OwnerName   string      `json:"owner_name"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Visibility  string      `json:"visibility"`
+	Slug        string      `json:"slug"` // 分享链接中使用的随机字符串
+	ItemCount   int32       `json:"item_count"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	Version     int32       `json:"version"`
+	Items       []*ListItem `json:"items,omitempty"`
+}
+
+// 片单中的一部电影
+type ListItem struct {
+	Position int32     `json:"position"`
+	AddedAt  time.Time `json:"added_at"`
+	Movie    *Movie    `json:"movie"`
+}
+
+// 查询片单时使用的字段 顺序与scanFields返回的一致
+const listColumns = `lists.id,lists.user_id,users.name,lists.name,lists.description,lists.visibility,lists.slug,
+			(SELECT count(*) FROM list_items INNER JOIN movies ON movies.id = list_items.movie_id
+			 WHERE list_items.list_id = lists.id AND movies.deleted_at IS NULL),
+			lists.created_at,lists.updated_at,lists.version`
+
+// 返回用于Scan的字段指针 与listColumns的顺序一致
+func (list *List) scanFields() []interface{} {
+	return []interface{}{
+		&list.ID,
+		&list.UserID,
+		&list.OwnerName,
+		&list.Name,
+		&list.Description,
+		&list.Visibility,
+		&list.Slug,
+		&list.ItemCount,
+		&list.CreatedAt,
+		&list.UpdatedAt,
+		&list.Version,
+	}
+}
+
+// 检查片单的信息
+func ValidateList(v *validator.Validator, list *List) {
+	v.Check(list.Name != "", "name", "must be provided")
+	v.Check(len(list.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(len(list.Description) <= 2000, "description", "must not be more than 2000 bytes long")
+	v.Check(validator.In(list.Visibility, ListVisibilities...), "visibility", "must be one of private, unlisted or public")
+}
+
+// 生成新的分享链接 80位的随机数无法被猜测
+func newListSlug() (string, error) {
+	return randomOAuthString(10)
+}
+
+// 解耦数据库连接池
+type ListModel struct {
+	db dbtx
+}
+
+// 创建新的片单并生成分享链接
+func (m ListModel) Insert(list *List) error {
+	slug, err := newListSlug()
+	if err != nil {
+		return err
+	}
+	stmt := `
+			INSERT INTO lists(user_id,name,description,visibility,slug)
+			VALUES ($1,$2,$3,$4,$5)
+			RETURNING id,created_at,updated_at,version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err = m.db.QueryRowContext(ctx, stmt, list.UserID, list.Name, list.Description, list.Visibility, slug).
+		Scan(&list.ID, &list.CreatedAt, &list.UpdatedAt, &list.Version)
+	if err != nil {
+		return err
+	}
+	list.Slug = slug
+	return nil
+}
+
+// 查询单个片单
+func (m ListModel) get(where string, args ...interface{}) (*List, error) {
+	stmt := `
+			SELECT ` + listColumns + `
+			FROM lists
+			INNER JOIN users ON users.id = lists.user_id
+			WHERE ` + where
+	var list List
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(list.scanFields()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &list, nil
+}
+
+// 查询用户自己的片单 片单不存在或属于其他用户时返回ErrRecordNotFound
+func (m ListModel) GetForUser(id, userID int64) (*List, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.get(`lists.id = $1 AND lists.user_id = $2`, id, userID)
+}
+
+// 使用分享链接查询片单 可见性由调用者检查
+func (m ListModel) GetBySlug(slug string) (*List, error) {
+	return m.get(`lists.slug = $1`, slug)
+}
+
+// 更新片单的信息(乐观锁)
+func (m ListModel) Update(list *List) error {
+	stmt := `
+			UPDATE lists
+			SET name = $1,description = $2,visibility = $3,slug = $4,updated_at = NOW(),version = version + 1
+			WHERE id = $5 AND version = $6
+			RETURNING updated_at,version`
+	args := []interface{}{list.Name, list.Description, list.Visibility, list.Slug, list.ID, list.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(&list.UpdatedAt, &list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// 重新生成分享链接 旧的链接随即失效
+func (m ListModel) RegenerateSlug(list *List) error {
+	slug, err := newListSlug()
+	if err != nil {
+		return err
+	}
+	list.Slug = slug
+	return m.Update(list)
+}
+
+// 删除用户自己的片单
+func (m ListModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM lists WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 分页查询片单
+func (m ListModel) getAll(where string, filters Filters, args ...interface{}) ([]*List, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),`+listColumns+`
+		FROM lists
+		INNER JOIN users ON users.id = lists.user_id
+		WHERE %s
+		ORDER BY lists.%s %s,lists.id ASC
+		LIMIT $%d OFFSET $%d`, where, filters.sortColumn(), filters.sortDirection(), len(args)+1, len(args)+2)
+	args = append(args, filters.limit(), filters.offset())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	lists := []*List{}
+	totalRows := 0
+	for rows.Next() {
+		var list List
+		err := rows.Scan(append([]interface{}{&totalRows}, list.scanFields()...)...)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		lists = append(lists, &list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return lists, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 列出用户自己的所有片单(包括私有的片单)
+func (m ListModel) GetAllForUser(userID int64, filters Filters) ([]*List, MetaData, error) {
+	return m.getAll(`lists.user_id = $1`, filters, userID)
+}
+
+// 列出公开的片单 name不为空时按名称搜索
+func (m ListModel) GetAllPublic(name string, filters Filters) ([]*List, MetaData, error) {
+	where := `lists.visibility = 'public'
+		AND (to_tsvector('simple',lists.name) @@ plainto_tsquery('simple',$1) OR $1 = '')`
+	return m.getAll(where, filters, name)
+}
+
+// 按顺序列出片单中的电影 已经删除的电影不会出现 但仍然占据原来的位置以便恢复
+func (m ListModel) GetItems(listID int64) ([]*ListItem, error) {
+	stmt := `
+			SELECT list_items.position,list_items.added_at,` + movieColumns + `
+			FROM list_items
+			INNER JOIN movies ON movies.id = list_items.movie_id
+			WHERE list_items.list_id = $1 AND movies.deleted_at IS NULL
+			ORDER BY list_items.position`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*ListItem{}
+	for rows.Next() {
+		item := ListItem{Movie: &Movie{}}
+		err = rows.Scan(append([]interface{}{&item.Position, &item.AddedAt}, item.Movie.scanFields()...)...)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// 列出用户所有的片单及其中的电影 用于导出用户的数据
+func (m ListModel) GetAllWithItems(userID int64) ([]*List, error) {
+	stmt := `
+			SELECT ` + listColumns + `
+			FROM lists
+			INNER JOIN users ON users.id = lists.user_id
+			WHERE lists.user_id = $1
+			ORDER BY lists.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lists := []*List{}
+	for rows.Next() {
+		var list List
+		err = rows.Scan(list.scanFields()...)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// 关闭结果集后再查询 避免在事务中同时使用同一个连接
+	rows.Close()
+	for _, list := range lists {
+		list.Items, err = m.GetItems(list.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// 在事务中修改片单中的电影
+// 锁定片单的记录 同一个片单的修改因此串行执行 position始终保持从1开始连续
+func (m ListModel) withItems(listID, userID int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	if listID < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	// 提交成功后Rollback不会产生任何影响
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM lists WHERE id = $1 AND user_id = $2 FOR UPDATE`, listID, userID).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE lists SET updated_at = NOW() WHERE id = $1`, listID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 将电影插入片单的指定位置 之后的电影依次后移
+// position为0或超出范围时加入到片单的末尾 返回电影最终的位置
+func (m ListModel) AddItem(listID, userID, movieID int64, position int32) (*ListItem, error) {
+	item := &ListItem{Movie: &Movie{ID: movieID}}
+	err := m.withItems(listID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		var count int32
+		err := tx.QueryRowContext(ctx, `SELECT count(*) FROM list_items WHERE list_id = $1`, listID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if position < 1 || position > count+1 {
+			position = count + 1
+		}
+		var exists bool
+		err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM movies WHERE id = $1 AND deleted_at IS NULL)`, movieID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUnknownMovie
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE list_items SET position = position + 1 WHERE list_id = $1 AND position >= $2`, listID, position)
+		if err != nil {
+			return err
+		}
+		stmt := `
+				INSERT INTO list_items(list_id,movie_id,position)
+				VALUES ($1,$2,$3)
+				RETURNING added_at`
+		err = tx.QueryRowContext(ctx, stmt, listID, movieID, position).Scan(&item.AddedAt)
+		if err != nil {
+			var pqerr *pq.Error
+			switch {
+			case isMissingMovie(err):
+				return ErrUnknownMovie
+			case errors.As(err, &pqerr) && pqerr.Code == "23505":
+				return ErrDuplicateListItem
+			default:
+				return err
+			}
+		}
+		item.Position = position
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// 将电影从片单中移除 之后的电影依次前移
+func (m ListModel) RemoveItem(listID, userID, movieID int64) error {
+	return m.withItems(listID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		var position int32
+		err := tx.QueryRowContext(ctx, `DELETE FROM list_items WHERE list_id = $1 AND movie_id = $2 RETURNING position`, listID, movieID).
+			Scan(&position)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE list_items SET position = position - 1 WHERE list_id = $1 AND position > $2`, listID, position)
+		return err
+	})
+}
+
+// 按movieIDs的顺序重新排列片单中的电影
+// movieIDs必须恰好包含片单中所有未删除的电影 否则返回ErrListItemsMismatch且不做任何修改
+// 已经删除的电影保持原来的相对顺序排在最后
+func (m ListModel) Reorder(listID, userID int64, movieIDs []int64) error {
+	return m.withItems(listID, userID, func(ctx context.Context, tx *sql.Tx) error {
+		var count int
+		stmt := `
+				SELECT count(*) FROM list_items
+				INNER JOIN movies ON movies.id = list_items.movie_id
+				WHERE list_items.list_id = $1 AND movies.deleted_at IS NULL`
+		err := tx.QueryRowContext(ctx, stmt, listID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count != len(movieIDs) {
+			return ErrListItemsMismatch
+		}
+		// position的唯一约束在提交时才检查 交换位置不会产生冲突
+		stmt = `
+				UPDATE list_items
+				SET position = $2 + trashed.rank
+				FROM (
+					SELECT list_items.movie_id,row_number() OVER (ORDER BY list_items.position) AS rank
+					FROM list_items
+					INNER JOIN movies ON movies.id = list_items.movie_id
+					WHERE list_items.list_id = $1 AND movies.deleted_at IS NOT NULL
+				) AS trashed
+				WHERE list_items.list_id = $1 AND list_items.movie_id = trashed.movie_id`
+		_, err = tx.ExecContext(ctx, stmt, listID, count)
+		if err != nil {
+			return err
+		}
+		stmt = `
+				UPDATE list_items
+				SET position = ordered.position
+				FROM unnest($2::bigint[]) WITH ORDINALITY AS ordered(movie_id,position)
+				WHERE list_items.list_id = $1 AND list_items.movie_id = ordered.movie_id
+				AND EXISTS (SELECT 1 FROM movies WHERE movies.id = list_items.movie_id AND movies.deleted_at IS NULL)`
+		result, err := tx.ExecContext(ctx, stmt, listID, pq.Array(movieIDs))
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// 有电影不在片单中或者重复出现
+		if rowsAffected != int64(len(movieIDs)) {
+			return ErrListItemsMismatch
+		}
+		return nil
+	})
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 登录失败的统计维度
+const (
+	LockoutAccount = "account"
+	LockoutIP      = "ip"
+)
+
+// 登录失败锁定的策略
+type LockoutPolicy struct {
+	Threshold   int           // 在Window内连续失败多少次后锁定 小于等于0时不锁定
+	Window      time.Duration // 超过这个时间没有再失败则重新开始计数
+	Duration    time.Duration // 第一次锁定的时长 之后每次锁定时长翻倍
+	MaxDuration time.Duration // 锁定时长的上限
+}
+
+// 计算第n次(从1开始)锁定的时长
+func (p LockoutPolicy) lockDuration(n int) time.Duration {
+	d := p.Duration
+	for i := 1; i < n && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDuration)
+}
+
+// 最后一次失败超过这个时间且没有处于锁定状态的记录会被清理
+// 需要比LockoutPolicy.Window更长 在此之前再次失败时锁定时长仍然会按锁定次数翻倍
+const LockoutRetention = 24 * time.Hour
+
+// 统一账号的格式 邮箱在数据库中不区分大小写
+func lockoutSubject(kind, subject string) string {
+	if kind == LockoutAccount {
+		return strings.ToLower(subject)
+	}
+	return subject
+}
+
+// 解耦数据库连接池
+type LockoutModel struct {
+	db dbtx
+}
+
+// 查询账号或IP的锁定状态 未被锁定时返回零值
+func (m LockoutModel) LockedUntil(kind, subject string) (time.Time, error) {
+	stmt := `
+			SELECT locked_until
+			FROM auth_failures
+			WHERE kind = $1 AND subject = $2 AND locked_until > NOW()`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var lockedUntil time.Time
+	err := m.db.QueryRowContext(ctx, stmt, kind, lockoutSubject(kind, subject)).Scan(&lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+// 记录一次登录失败 若这次失败触发了锁定则返回锁定的截止时间 否则返回零值
+func (m LockoutModel) RecordFailure(kind, subject string, policy LockoutPolicy) (time.Time, error) {
+	if policy.Threshold <= 0 {
+		return time.Time{}, nil
+	}
+	subject = lockoutSubject(kind, subject)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+	// 距离上一次失败超过窗口期则重新计数 更新时会锁住这一行直到事务结束
+	stmt := `
+			INSERT INTO auth_failures(kind,subject,failures,last_failure_at)
+			VALUES ($1,$2,1,NOW())
+			ON CONFLICT (kind,subject) DO UPDATE
+			SET failures = CASE
+			    	WHEN auth_failures.last_failure_at < NOW() - make_interval(secs => $3) THEN 1
+			    	ELSE auth_failures.failures + 1
+			    END,
+			    last_failure_at = NOW()
+			RETURNING failures,lock_count`
+	var failures, lockCount int
+	err = tx.QueryRowContext(ctx, stmt, kind, subject, policy.Window.Seconds()).Scan(&failures, &lockCount)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if failures < policy.Threshold {
+		return time.Time{}, tx.Commit()
+	}
+	// 达到阈值 锁定并清空计数 锁定的时长随锁定次数增长
+	lockCount++
+	lockedUntil := time.Now().Add(policy.lockDuration(lockCount))
+	stmt = `
+			UPDATE auth_failures
+			SET failures = 0, lock_count = $3, locked_until = $4
+			WHERE kind = $1 AND subject = $2`
+	_, err = tx.ExecContext(ctx, stmt, kind, subject, lockCount, lockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil, tx.Commit()
+}
+
+// 清除失败记录与锁定状态 在登录成功或管理员解锁时调用
+func (m LockoutModel) Reset(kind, subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, `DELETE FROM auth_failures WHERE kind = $1 AND subject = $2`, kind, lockoutSubject(kind, subject))
+	return err
+}
+
+// 删除在now时已经没有作用的失败记录 返回删除的数量
+// 不存在的邮箱同样会留下记录 不清理的话任何人都可以通过随意登录使这张表无限增长
+func (m LockoutModel) DeleteExpired(now time.Time) (int64, error) {
+	stmt := `
+			DELETE FROM auth_failures
+			WHERE (locked_until IS NULL OR locked_until < $1) AND last_failure_at < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, stmt, now, now.Add(-LockoutRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
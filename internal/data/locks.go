@@ -0,0 +1,50 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"time"
+)
+
+// 解耦数据库连接池
+type LockModel struct {
+	db *sql.DB
+}
+
+// 将锁的名称转换为PostgreSQL咨询锁使用的64位键
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("cinelight:" + name))
+	return int64(h.Sum64())
+}
+
+// 尝试获取名为name的咨询锁并在持有锁期间执行fn
+// 锁已经被其他实例持有时不会执行fn 返回false
+// 咨询锁属于会话级别 必须在同一个连接上获取与释放
+func (m LockModel) TryRun(name string, fn func() error) (bool, error) {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	key := lockKey(name)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var acquired bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired)
+	if err != nil || !acquired {
+		return false, err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key)
+		if err != nil {
+			// 无法释放锁时丢弃这个连接 关闭会话会自动释放锁 避免锁随连接回到连接池
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+	return true, fn()
+}
@@ -0,0 +1,188 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"greenlight.vdebu.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// 每次生成的恢复码数量
+const recoveryCodeCount = 10
+
+// 用户的TOTP配置
+type TOTP struct {
+	UserID       int64
+	Secret       []byte
+	Confirmed    bool  // 是否已经通过第一次验证 只有确认后才会在登录时要求验证码
+	LastUsedStep int64 // 最后一次使用的时间窗口 防止验证码被重放
+}
+
+// 解耦数据库连接池
+type MFAModel struct {
+	db dbtx
+}
+
+// 检查用户输入的TOTP验证码格式
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// 生成一组一次性的恢复码 格式为xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		codes[i] = encoded[:5] + "-" + encoded[5:10]
+	}
+	return codes, nil
+}
+
+// 查询用户的TOTP配置
+func (m MFAModel) GetTOTP(userID int64) (*TOTP, error) {
+	stmt := `
+			SELECT user_id,secret,confirmed,last_used_step
+			FROM user_totp
+			WHERE user_id = $1`
+	var totp TOTP
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, userID).Scan(&totp.UserID, &totp.Secret, &totp.Confirmed, &totp.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// 为用户写入新的未确认TOTP密钥 已经确认的密钥不会被覆盖
+func (m MFAModel) SetTOTP(userID int64, secret []byte) error {
+	stmt := `
+			INSERT INTO user_totp(user_id,secret)
+			VALUES ($1,$2)
+			ON CONFLICT (user_id) DO UPDATE
+			SET secret = EXCLUDED.secret,created_at = NOW()
+			WHERE user_totp.confirmed = false`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, secret)
+	return err
+}
+
+// 确认TOTP密钥 同时生成新的恢复码 返回恢复码的明文(只会返回这一次)
+func (m MFAModel) ConfirmTOTP(userID, step int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// 记录确认时使用的时间窗口 该验证码不能再用于登录
+	stmt := `
+			UPDATE user_totp
+			SET confirmed = true,last_used_step = $2
+			WHERE user_id = $1 AND confirmed = false`
+	result, err := tx.ExecContext(ctx, stmt, userID, step)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+	// 替换掉之前的恢复码
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash := sha256.Sum256([]byte(code))
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_recovery_codes(user_id,hash) VALUES ($1,$2)`, userID, hash[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// 记录已经使用的时间窗口 若该窗口(或更晚的窗口)已被使用过则返回false
+func (m MFAModel) UseTOTPStep(userID, step int64) (bool, error) {
+	stmt := `
+			UPDATE user_totp
+			SET last_used_step = $2
+			WHERE user_id = $1 AND confirmed = true AND last_used_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, stmt, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// 使用一个恢复码 恢复码不存在或已经被使用过时返回false
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	stmt := `
+			UPDATE user_recovery_codes
+			SET used_at = NOW()
+			WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, stmt, userID, hash[:])
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// 关闭用户的TOTP 同时删除所有的恢复码
+func (m MFAModel) DeleteTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
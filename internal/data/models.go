@@ -1,31 +1,109 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // 自定义错误类型
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	// 需要自己开启事务的方法不能在Models.Transaction中使用
+	ErrNestedTransaction = errors.New("nested transaction")
 )
 
+// *sql.DB与*sql.Tx共同的方法 模型通过它访问数据库 因此同一个模型既可以直接使用也可以在事务中使用
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// 为需要多条语句原子执行的方法开启事务
+func beginTx(ctx context.Context, db dbtx) (*sql.Tx, error) {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return nil, ErrNestedTransaction
+	}
+	return sqlDB.BeginTx(ctx, nil)
+}
+
 // 存储各种数据模型 这样存储进去不会包含sql.db相当于是将其隐藏了 只会包含方法不会包含原始字段？
 type Models struct {
-	Movies      MovieModel
-	User        UserModel
-	Token       TokenModel
-	Permissions PermissionModel
+	Movies       MovieModel
+	People       PersonModel
+	Reviews      ReviewModel
+	Watch        WatchModel
+	Lists        ListModel
+	User         UserModel
+	Token        TokenModel
+	Permissions  PermissionModel
+	Denylist     DenylistModel
+	APIKeys      APIKeyModel
+	MFA          MFAModel
+	Roles        RoleModel
+	Lockout      LockoutModel
+	EmailChanges EmailChangeModel
+	Invitations  InvitationModel
+	Identities   IdentityModel
+	OAuth        OAuthModel
+	Locks        LockModel
+	Outbox       OutboxModel
+	db           *sql.DB // 用于开启事务
 }
 
 // 创建新的模型实例
 func NewModels(db *sql.DB) Models {
+	models := newModels(db)
+	models.Locks = LockModel{db: db}
+	models.db = db
+	return models
+}
+
+// 在同一个事务中执行fn 传入fn的模型的所有操作都属于这个事务 fn返回错误时回滚
+func (m Models) Transaction(fn func(tx Models) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// 提交成功后Rollback不会产生任何影响
+	defer tx.Rollback()
+	models := newModels(tx)
+	// 咨询锁属于连接而不是事务 仍然使用连接池
+	models.Locks = m.Locks
+	err = fn(models)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 使用同一个数据库连接(或事务)初始化所有的数据模型
+func newModels(db dbtx) Models {
 	return Models{
 		// 初始化数据模型的数据库连接池
-		Movies:      MovieModel{db: db},
-		User:        UserModel{db: db},
-		Token:       TokenModel{db: db},
-		Permissions: PermissionModel{db: db},
+		Movies:       MovieModel{db: db},
+		People:       PersonModel{db: db},
+		Reviews:      ReviewModel{db: db},
+		Watch:        WatchModel{db: db},
+		Lists:        ListModel{db: db},
+		User:         UserModel{db: db},
+		Token:        TokenModel{db: db},
+		Permissions:  PermissionModel{db: db},
+		Denylist:     DenylistModel{db: db},
+		APIKeys:      APIKeyModel{db: db},
+		MFA:          MFAModel{db: db},
+		Roles:        RoleModel{db: db},
+		Lockout:      LockoutModel{db: db},
+		EmailChanges: EmailChangeModel{db: db},
+		Invitations:  InvitationModel{db: db},
+		Identities:   IdentityModel{db: db},
+		OAuth:        OAuthModel{db: db},
+		Outbox:       OutboxModel{db: db},
 	}
 }
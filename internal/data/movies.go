@@ -12,13 +12,35 @@ import (
 
 // 使用结构体存储基本信息
 type Movie struct {
-	ID        int64     `json:"id"`                // 唯一标识
-	CreatedAt time.Time `json:"-"`                 // 加入数据库的时间 对数据库中的创建时间字段进行隐藏
-	Title     string    `json:"title"`             // 标题
-	Year      int32     `json:"year,omitempty"`    // 发行时间
-	Runtime   Runtime   `json:"runtime,omitempty"` // 时长 使用自定义类型存储播放时长(实现了json.Marshal接口)生成自定义的格式化信息
-	Genres    []string  `json:"genres,omitempty"`  // 标签 对发行时间时长标签进行空值隐藏("",0,nil或空slice,map)
-	Version   int32     `json:"version"`           // 版本信息从1开始 当电影信息更新版本信息会自动递增
+	ID        int64      `json:"id"`                   // 唯一标识
+	CreatedAt time.Time  `json:"-"`                    // 加入数据库的时间 对数据库中的创建时间字段进行隐藏
+	Title     string     `json:"title"`                // 标题
+	Year      int32      `json:"year,omitempty"`       // 发行时间
+	Runtime   Runtime    `json:"runtime,omitempty"`    // 时长 使用自定义类型存储播放时长(实现了json.Marshal接口)生成自定义的格式化信息
+	Genres    []string   `json:"genres,omitempty"`     // 标签 对发行时间时长标签进行空值隐藏("",0,nil或空slice,map)
+	Rating    float64    `json:"rating"`               // 用户评分的平均值 随评论的变更在同一个事务中更新
+	Votes     int32      `json:"votes"`                // 评分的人数
+	Version   int32      `json:"version"`              // 版本信息从1开始 当电影信息更新版本信息会自动递增
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // 被删除的时间 只有已删除的电影才有这个字段
+}
+
+// 与其他表连接查询电影时使用的字段 顺序与scanFields返回的一致
+const movieColumns = `movies.id,movies.created_at,movies.title,movies.year,movies.runtime,movies.genres,
+			movies.rating,movies.votes,movies.version`
+
+// 返回用于Scan的字段指针 与movieColumns的顺序一致
+func (movie *Movie) scanFields() []interface{} {
+	return []interface{}{
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Rating,
+		&movie.Votes,
+		&movie.Version,
+	}
 }
 
 // 用于检测电影结构体的各个字段是否有效
@@ -44,7 +66,7 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 // 创建模型存储数据库连接池
 type MovieModel struct {
-	db *sql.DB
+	db dbtx
 }
 
 // 向数据库插入新数据
@@ -70,9 +92,9 @@ func (m *MovieModel) Get(id int64) (*Movie, error) {
 		// 记录是从1开始的
 		return nil, ErrRecordNotFound
 	}
-	stmt := `SELECT id,created_at,title,year,runtime,genres,version 
+	stmt := `SELECT id,created_at,title,year,runtime,genres,rating,votes,version
 			FROM movies
-			WHERE id = $1`
+			WHERE id = $1 AND deleted_at IS NULL`
 	// 存储查询到的数据
 	var movie Movie
 	// 使用ContextWithTimeout定义查询进行的最长时间
@@ -84,7 +106,7 @@ func (m *MovieModel) Get(id int64) (*Movie, error) {
 	// 将ctx传入设置DeadLine
 	// 使用pq.Array()对查询到的数据进行转换以后存入结构体 使用空的字节数组存储pq_sleep返回的数据
 	err := m.db.QueryRowContext(ctx, stmt, id).Scan(
-		&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Version)
+		&movie.ID, &movie.CreatedAt, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres), &movie.Rating, &movie.Votes, &movie.Version)
 	if err != nil {
 		// 判断是不是sql的no row 错误
 		if errors.Is(err, sql.ErrNoRows) {
@@ -102,7 +124,7 @@ func (m *MovieModel) Update(movie *Movie) error {
 	// 基于表中的VERSION字段实现乐观锁
 	stmt := `UPDATE movies
 			SET title = $1,year = $2,runtime = $3,genres = $4,version = version + 1
-			WHERE id = $5 AND version = $6
+			WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 			RETURNING version`
 	// 存储要使用的参数
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
@@ -123,13 +145,13 @@ func (m *MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-// 根据id从数据库中删除数据
+// 根据id删除数据 只记录删除的时间 保留期内可以恢复
 func (m *MovieModel) Delete(id int64) error {
 	// 先判断id的基础有效性防止进行不必要的查询
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	stmt := `DELETE FROM movies WHERE id = $1`
+	stmt := `UPDATE movies SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 	result, err := m.db.ExecContext(ctx, stmt, id)
@@ -150,21 +172,24 @@ func (m *MovieModel) Delete(id int64) error {
 }
 
 // 根据query url的参数返回需要展示的数据信息与当前页面的统计信息
-func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, MetaData, error) {
+// excludeWatchedBy不为0时排除该用户已经看过的电影
+func (m *MovieModel) GetAll(title string, genres []string, excludeWatchedBy int64, filters Filters) ([]*Movie, MetaData, error) {
 	// 使用fmt.Sprintf动态生成查询语句(查询关键字是不能用占位符插入的) 确保ORDER BY 作用于一个一定存在的key保证输出是有序的
 	// psql若没有指定排序输出顺序是随机的
 	stmt := fmt.Sprintf(`
-		SELECT count(*) OVER(),id,created_at,title,year,runtime,genres,version
+		SELECT count(*) OVER(),id,created_at,title,year,runtime,genres,rating,votes,version
 		FROM movies
 		WHERE (to_tsvector('simple',title) @@ plainto_tsquery('simple',$1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
+		AND deleted_at IS NULL
+		AND ($5::bigint = 0 OR NOT EXISTS (SELECT 1 FROM watch_history WHERE watch_history.movie_id = movies.id AND watch_history.user_id = $5))
 		ORDER BY %s %s,id ASC
 		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 	// 创建DeadLine
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 	// 将page相关数值使用占位符传入查询语句
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset(), excludeWatchedBy}
 	// 执行查询请求
 	rows, err := m.db.QueryContext(ctx, stmt, args...)
 	if err != nil {
@@ -187,6 +212,8 @@ func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Rating,
+			&movie.Votes,
 			&movie.Version,
 		)
 		if err != nil {
@@ -202,3 +229,67 @@ func (m *MovieModel) GetAll(title string, genres []string, filters Filters) ([]*
 	metaData := calculateMetadata(totalRows, filters.Page, filters.PageSize)
 	return movies, metaData, nil
 }
+
+// 恢复已经删除的电影 电影不存在或没有被删除时返回ErrRecordNotFound
+func (m *MovieModel) Restore(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	stmt := `UPDATE movies SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+	rowAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 列出已经删除的电影 返回当前页的数据与分页信息
+func (m *MovieModel) GetAllDeleted(filters Filters) ([]*Movie, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),deleted_at,`+movieColumns+`
+		FROM movies
+		WHERE deleted_at IS NOT NULL
+		ORDER BY %s %s,id ASC
+		LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	movies := []*Movie{}
+	totalRows := 0
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(append([]interface{}{&totalRows, &movie.DeletedAt}, movie.scanFields()...)...)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return movies, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 彻底删除在before之前删除的电影 返回删除的数量
+func (m *MovieModel) PurgeDeleted(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM movies WHERE deleted_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
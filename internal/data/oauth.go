@@ -0,0 +1,387 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 签发给第三方应用的访问Token的固定前缀 认证中间件据此区分Token的类型
+const OAuthTokenPrefix = "oat_"
+
+// 在本服务注册的第三方应用
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"` // 明文只会在创建时返回一次
+	SecretHash   []byte      `json:"-"`
+	Name         string      `json:"name"`
+	OwnerID      int64       `json:"owner_id"` // 使用client_credentials时以该用户的身份访问
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"` // 应用最多可以申请的scope
+	Confidential bool        `json:"confidential"`
+}
+
+// 用户同意授权后签发的授权码
+type OAuthCode struct {
+	ClientID      string
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+}
+
+// 签发给第三方应用的访问Token
+type OAuthToken struct {
+	Plaintext string
+	ClientID  string
+	UserID    int64
+	Scopes    Permissions
+	CreatedAt time.Time
+	Expiry    time.Time
+}
+
+// 解耦数据库连接池
+type OAuthModel struct {
+	db dbtx
+}
+
+// 生成指定字节数的随机字符串(小写base32)
+func randomOAuthString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)), nil
+}
+
+// 检查注册第三方应用时输入的信息
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	// 公共客户端只能使用授权码流程 必须提供回调地址
+	v.Check(client.Confidential || len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 uri for public clients")
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		v.Check(err == nil && u.IsAbs() && u.Host != "" && u.Fragment == "", "redirect_uris", "must be absolute uris without a fragment")
+	}
+}
+
+// 检查访问Token明文的基础格式
+func ValidateOAuthTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+	v.Check(strings.HasPrefix(tokenPlaintext, OAuthTokenPrefix), "token", "must be a valid access token")
+	v.Check(len(tokenPlaintext) == len(OAuthTokenPrefix)+26, "token", "must be 30 bytes long")
+}
+
+// 检查客户端秘钥是否匹配 公共客户端总是返回false
+func (c *OAuthClient) MatchesSecret(secret string) bool {
+	if !c.Confidential {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// 注册新的第三方应用 机密客户端会生成秘钥
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	var err error
+	client.ClientID, err = randomOAuthString(10)
+	if err != nil {
+		return err
+	}
+	if client.Confidential {
+		secret, err := randomOAuthString(20)
+		if err != nil {
+			return err
+		}
+		client.Secret = "ocs_" + secret
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+	if client.RedirectURIs == nil {
+		client.RedirectURIs = []string{}
+	}
+	stmt := `
+			INSERT INTO oauth_clients(client_id,secret_hash,name,owner_id,redirect_uris,scopes)
+			VALUES ($1,$2,$3,$4,$5,$6)
+			RETURNING id,created_at`
+	args := []interface{}{
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		client.OwnerID,
+		pq.Array(client.RedirectURIs),
+		pq.Array([]string(client.Scopes)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// 查询第三方应用时使用的字段
+const selectOAuthClients = `
+			SELECT id,created_at,client_id,secret_hash,name,owner_id,redirect_uris,scopes
+			FROM oauth_clients`
+
+// 从数据库的一行中读取第三方应用
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (*OAuthClient, error) {
+	var client OAuthClient
+	err := row.Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		&client.OwnerID,
+		pq.Array(&client.RedirectURIs),
+		pq.Array((*[]string)(&client.Scopes)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// 使用client_id查询第三方应用
+func (m OAuthModel) GetClient(clientID string) (*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := scanOAuthClient(m.db.QueryRowContext(ctx, selectOAuthClients+` WHERE client_id = $1`, clientID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// 列出所有的第三方应用
+func (m OAuthModel) GetAllClients() ([]*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, selectOAuthClients+` ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// 删除第三方应用 已经签发的授权码与Token会被级联删除
+func (m OAuthModel) DeleteClient(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM oauth_clients WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 签发新的授权码 返回授权码的明文
+func (m OAuthModel) NewCode(code *OAuthCode, ttl time.Duration) (string, error) {
+	plaintext, err := randomOAuthString(20)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(plaintext))
+	stmt := `
+			INSERT INTO oauth_codes(hash,client_id,user_id,redirect_uri,scopes,code_challenge,expiry)
+			VALUES ($1,$2,$3,$4,$5,$6,$7)`
+	args := []interface{}{
+		hash[:],
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		pq.Array([]string(code.Scopes)),
+		code.CodeChallenge,
+		time.Now().Add(ttl),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = m.db.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return "", err
+	}
+	return plaintext, nil
+}
+
+// 取出并删除授权码 每个授权码只能使用一次 同时清理已经过期的授权码
+func (m OAuthModel) ConsumeCode(plaintext string) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	stmt := `
+			WITH expired AS (
+				DELETE FROM oauth_codes WHERE expiry <= $2
+			)
+			DELETE FROM oauth_codes
+			WHERE hash = $1 AND expiry > $2
+			RETURNING client_id,user_id,redirect_uri,scopes,code_challenge`
+	var code OAuthCode
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, hash[:], time.Now()).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array((*[]string)(&code.Scopes)),
+		&code.CodeChallenge,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &code, nil
+}
+
+// 为第三方应用签发访问Token
+func (m OAuthModel) NewToken(clientID string, userID int64, scopes Permissions, ttl time.Duration) (*OAuthToken, error) {
+	plaintext, err := randomOAuthString(16)
+	if err != nil {
+		return nil, err
+	}
+	token := &OAuthToken{
+		Plaintext: OAuthTokenPrefix + plaintext,
+		ClientID:  clientID,
+		UserID:    userID,
+		Scopes:    scopes,
+		Expiry:    time.Now().Add(ttl),
+	}
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	stmt := `
+			INSERT INTO oauth_tokens(hash,client_id,user_id,scopes,expiry)
+			VALUES ($1,$2,$3,$4,$5)
+			RETURNING created_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = m.db.QueryRowContext(ctx, stmt, hash[:], clientID, userID, pq.Array([]string(scopes)), token.Expiry).Scan(&token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// 查询仍然有效的访问Token 用于令牌内省
+func (m OAuthModel) GetToken(plaintext string) (*OAuthToken, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	stmt := `
+			SELECT client_id,user_id,scopes,created_at,expiry
+			FROM oauth_tokens
+			WHERE hash = $1 AND expiry > $2`
+	token := OAuthToken{Plaintext: plaintext}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, hash[:], time.Now()).Scan(
+		&token.ClientID,
+		&token.UserID,
+		pq.Array((*[]string)(&token.Scopes)),
+		&token.CreatedAt,
+		&token.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// 使用访问Token查询其代表的用户与被授予的scope
+func (m OAuthModel) GetForToken(plaintext string) (*User, Permissions, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	stmt := `
+			SELECT ` + userColumns + `,oauth_tokens.scopes
+			FROM users
+			INNER JOIN oauth_tokens ON oauth_tokens.user_id = users.id
+			WHERE oauth_tokens.hash = $1 AND oauth_tokens.expiry > $2`
+	var (
+		user   User
+		scopes Permissions
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, hash[:], time.Now()).Scan(
+		append(user.scanFields(), pq.Array((*[]string)(&scopes)))...,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &user, scopes, nil
+}
+
+// 撤销第三方应用自己的访问Token 不属于该应用的Token不会被撤销
+func (m OAuthModel) RevokeToken(plaintext, clientID string) error {
+	hash := sha256.Sum256([]byte(plaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, `DELETE FROM oauth_tokens WHERE hash = $1 AND client_id = $2`, hash[:], clientID)
+	return err
+}
+
+// 删除所有已经过期的授权码与访问Token 返回删除的数量
+func (m OAuthModel) DeleteExpired(now time.Time) (int64, error) {
+	stmt := `
+			WITH codes AS (
+				DELETE FROM oauth_codes WHERE expiry <= $1
+				RETURNING 1
+			), tokens AS (
+				DELETE FROM oauth_tokens WHERE expiry <= $1
+				RETURNING 1
+			)
+			SELECT (SELECT count(*) FROM codes) + (SELECT count(*) FROM tokens)`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var deleted int64
+	err := m.db.QueryRowContext(ctx, stmt, now).Scan(&deleted)
+	return deleted, err
+}
@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 邮件在发件箱中的状态
+const (
+	OutboxPending = "pending" // 等待发送或等待重试
+	OutboxSent    = "sent"    // 已经发送
+	OutboxDead    = "dead"    // 超过最大重试次数 需要管理员重新加入队列
+)
+
+// 发件箱中的一封邮件 写入时已经完成了模板的渲染
+type OutboxMessage struct {
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	PlainBody     string     `json:"-"`
+	HTMLBody      string     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+// 解耦数据库连接池
+type OutboxModel struct {
+	db dbtx
+}
+
+// 将邮件加入发件箱 在事务中使用时邮件只有在事务提交后才会被发送
+func (m OutboxModel) Insert(msg *OutboxMessage) error {
+	stmt := `
+			INSERT INTO email_outbox(recipient,subject,plain_body,html_body)
+			VALUES ($1,$2,$3,$4)
+			RETURNING id,created_at,status,next_attempt_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, msg.Recipient, msg.Subject, msg.PlainBody, msg.HTMLBody).
+		Scan(&msg.ID, &msg.CreatedAt, &msg.Status, &msg.NextAttemptAt)
+}
+
+// 领取最多limit封到期的邮件并增加尝试次数
+// 领取后的lease时间内其他发送者不会再领取这些邮件 发送者崩溃时邮件会在lease之后被重新领取
+// 使用SKIP LOCKED 多个发送者(或多个实例)可以同时领取而不会重复
+func (m OutboxModel) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	stmt := `
+			UPDATE email_outbox
+			SET attempts = attempts + 1, next_attempt_at = $3
+			WHERE id IN (
+				SELECT id FROM email_outbox
+				WHERE status = $1 AND next_attempt_at <= NOW()
+				ORDER BY next_attempt_at
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id,created_at,recipient,subject,plain_body,html_body,status,attempts,next_attempt_at,last_error`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, OutboxPending, limit, time.Now().Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		var msg OutboxMessage
+		err = rows.Scan(
+			&msg.ID,
+			&msg.CreatedAt,
+			&msg.Recipient,
+			&msg.Subject,
+			&msg.PlainBody,
+			&msg.HTMLBody,
+			&msg.Status,
+			&msg.Attempts,
+			&msg.NextAttemptAt,
+			&msg.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// 标记邮件已经发送 同时清除邮件正文
+// 正文中包含激活/重置密码等Token的明文 发送后不再需要保留
+func (m OutboxModel) MarkSent(id int64) error {
+	stmt := `
+			UPDATE email_outbox
+			SET status = $2, sent_at = NOW(), plain_body = '', html_body = ''
+			WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, id, OutboxSent)
+	return err
+}
+
+// 记录一次发送失败 dead为true时不再重试 否则在next之后重试
+func (m OutboxModel) MarkFailed(id int64, sendErr string, dead bool, next time.Time) error {
+	status := OutboxPending
+	if dead {
+		status = OutboxDead
+	}
+	stmt := `
+			UPDATE email_outbox
+			SET status = $2, last_error = $3, next_attempt_at = $4
+			WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, id, status, sendErr, next)
+	return err
+}
+
+// 列出所有发送失败过且尚未发送成功的邮件 包括已经放弃的与等待重试的
+func (m OutboxModel) GetAllFailed() ([]*OutboxMessage, error) {
+	stmt := `
+			SELECT id,created_at,recipient,subject,status,attempts,next_attempt_at,last_error
+			FROM email_outbox
+			WHERE status = $1 OR (status = $2 AND last_error <> '')
+			ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, OutboxDead, OutboxPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []*OutboxMessage{}
+	for rows.Next() {
+		var msg OutboxMessage
+		err = rows.Scan(
+			&msg.ID,
+			&msg.CreatedAt,
+			&msg.Recipient,
+			&msg.Subject,
+			&msg.Status,
+			&msg.Attempts,
+			&msg.NextAttemptAt,
+			&msg.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// 将已经放弃的邮件重新加入队列 尝试次数从零开始计算
+// 邮件正文在加入发件箱时已经渲染 其中的Token可能已经过期 收件人需要重新申请
+func (m OutboxModel) Requeue(id int64) (*OutboxMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	stmt := `
+			UPDATE email_outbox
+			SET status = $2, attempts = 0, next_attempt_at = NOW()
+			WHERE id = $1 AND status = $3
+			RETURNING id,created_at,recipient,subject,status,attempts,next_attempt_at,last_error`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var msg OutboxMessage
+	err := m.db.QueryRowContext(ctx, stmt, id, OutboxPending, OutboxDead).Scan(
+		&msg.ID,
+		&msg.CreatedAt,
+		&msg.Recipient,
+		&msg.Subject,
+		&msg.Status,
+		&msg.Attempts,
+		&msg.NextAttemptAt,
+		&msg.LastError,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &msg, nil
+}
+
+// 删除在before之前已经发送的邮件 返回删除的数量
+func (m OutboxModel) DeleteSent(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM email_outbox WHERE status = $1 AND sent_at < $2`, OutboxSent, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// 删除在before之前加入发件箱且已经放弃的邮件 返回删除的数量
+// 放弃的邮件保留正文以便重新加入队列 超过保留期后连同正文一起删除
+func (m OutboxModel) DeleteDead(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM email_outbox WHERE status = $1 AND created_at < $2`, OutboxDead, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
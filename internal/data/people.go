@@ -0,0 +1,311 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"time"
+)
+
+// 同一个人已经以相同的职务(与角色名)出现在电影中
+var ErrDuplicateCredit = errors.New("duplicate credit")
+
+// 演职人员在电影中可以担任的职务
+const (
+	CreditDirector = "director"
+	CreditWriter   = "writer"
+	CreditActor    = "actor"
+	CreditComposer = "composer"
+)
+
+// 所有可用的职务
+var CreditRoles = []string{CreditDirector, CreditWriter, CreditActor, CreditComposer}
+
+// 演职人员的基本信息
+type Person struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Name      string    `json:"name"`
+	BirthYear *int32    `json:"birth_year,omitempty"` // 未知时为nil
+	Biography string    `json:"biography,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+// 演职人员在某部电影中的职务
+// 按电影查询时填充Person 按人员查询(作品列表)时填充Movie
+type Credit struct {
+	ID           int64   `json:"id"`
+	MovieID      int64   `json:"-"`
+	PersonID     int64   `json:"-"`
+	Person       *Person `json:"person,omitempty"`
+	Movie        *Movie  `json:"movie,omitempty"`
+	Role         string  `json:"role"`
+	Character    string  `json:"character,omitempty"` // 只有演员才有角色名
+	BillingOrder int32   `json:"billing_order"`
+}
+
+// 检查演职人员的信息
+func ValidatePerson(v *validator.Validator, person *Person) {
+	v.Check(person.Name != "", "name", "must be provided")
+	v.Check(len(person.Name) <= 500, "name", "must not be more than 500 bytes long")
+	if person.BirthYear != nil {
+		v.Check(*person.BirthYear >= 1800, "birth_year", "must be greater than 1800")
+		v.Check(*person.BirthYear <= int32(time.Now().Year()), "birth_year", "must not be in the future")
+	}
+	v.Check(len(person.Biography) <= 10_000, "biography", "must not be more than 10000 bytes long")
+}
+
+// 检查职务的信息
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "must be provided")
+	v.Check(validator.In(credit.Role, CreditRoles...), "role", "must be one of director, writer, actor, composer")
+	v.Check(credit.Role == CreditActor || credit.Character == "", "character", "must only be provided for actors")
+	v.Check(len(credit.Character) <= 500, "character", "must not be more than 500 bytes long")
+	v.Check(credit.BillingOrder >= 0, "billing_order", "must not be negative")
+}
+
+// 解耦数据库连接池
+type PersonModel struct {
+	db dbtx
+}
+
+// 向数据库插入新的演职人员
+func (m PersonModel) Insert(person *Person) error {
+	stmt := `
+			INSERT INTO people(name,birth_year,biography)
+			VALUES ($1,$2,$3)
+			RETURNING id,created_at,version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.db.QueryRowContext(ctx, stmt, person.Name, person.BirthYear, person.Biography).
+		Scan(&person.ID, &person.CreatedAt, &person.Version)
+}
+
+// 使用id查询演职人员
+func (m PersonModel) Get(id int64) (*Person, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	stmt := `
+			SELECT id,created_at,name,birth_year,biography,version
+			FROM people
+			WHERE id = $1`
+	var person Person
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, id).Scan(
+		&person.ID, &person.CreatedAt, &person.Name, &person.BirthYear, &person.Biography, &person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &person, nil
+}
+
+// 更新演职人员的信息(乐观锁)
+func (m PersonModel) Update(person *Person) error {
+	stmt := `
+			UPDATE people
+			SET name = $1,birth_year = $2,biography = $3,version = version + 1
+			WHERE id = $4 AND version = $5
+			RETURNING version`
+	args := []interface{}{person.Name, person.BirthYear, person.Biography, person.ID, person.Version}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(&person.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// 删除演职人员 其在所有电影中的职务会被一并删除
+func (m PersonModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM people WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 根据名字查询演职人员 返回当前页的数据与分页信息
+func (m PersonModel) GetAll(name string, filters Filters) ([]*Person, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),id,created_at,name,birth_year,biography,version
+		FROM people
+		WHERE (to_tsvector('simple',name) @@ plainto_tsquery('simple',$1) OR $1 = '')
+		ORDER BY %s %s,id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, name, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	people := []*Person{}
+	totalRows := 0
+	for rows.Next() {
+		var person Person
+		err := rows.Scan(
+			&totalRows,
+			&person.ID,
+			&person.CreatedAt,
+			&person.Name,
+			&person.BirthYear,
+			&person.Biography,
+			&person.Version,
+		)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		people = append(people, &person)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return people, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 为电影添加演职人员的职务
+func (m PersonModel) InsertCredit(credit *Credit) error {
+	stmt := `
+			INSERT INTO movie_credits(movie_id,person_id,role,character,billing_order)
+			VALUES ($1,$2,$3,$4,$5)
+			RETURNING id`
+	args := []interface{}{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(&credit.ID)
+	if err != nil {
+		var pqerr *pq.Error
+		if errors.As(err, &pqerr) && pqerr.Code == "23505" {
+			return ErrDuplicateCredit
+		}
+		return err
+	}
+	return nil
+}
+
+// 删除电影中的某个职务
+func (m PersonModel) DeleteCredit(movieID, creditID int64) error {
+	if creditID < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM movie_credits WHERE id = $1 AND movie_id = $2`, creditID, movieID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 列出电影的所有演职人员 按署名顺序排列
+func (m PersonModel) GetCreditsForMovie(movieID int64) ([]*Credit, error) {
+	stmt := `
+			SELECT movie_credits.id,movie_credits.role,movie_credits.character,movie_credits.billing_order,
+			       people.id,people.created_at,people.name,people.birth_year,people.biography,people.version
+			FROM movie_credits
+			INNER JOIN people ON people.id = movie_credits.person_id
+			WHERE movie_credits.movie_id = $1
+			ORDER BY movie_credits.billing_order,movie_credits.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	credits := []*Credit{}
+	for rows.Next() {
+		credit := Credit{MovieID: movieID, Person: &Person{}}
+		err = rows.Scan(
+			&credit.ID,
+			&credit.Role,
+			&credit.Character,
+			&credit.BillingOrder,
+			&credit.Person.ID,
+			&credit.Person.CreatedAt,
+			&credit.Person.Name,
+			&credit.Person.BirthYear,
+			&credit.Person.Biography,
+			&credit.Person.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		credit.PersonID = credit.Person.ID
+		credits = append(credits, &credit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credits, nil
+}
+
+// 列出演职人员参与的所有电影 按上映年份从新到旧排列
+func (m PersonModel) GetFilmography(personID int64) ([]*Credit, error) {
+	stmt := `
+			SELECT movie_credits.id,movie_credits.role,movie_credits.character,movie_credits.billing_order,
+			       ` + movieColumns + `
+			FROM movie_credits
+			INNER JOIN movies ON movies.id = movie_credits.movie_id
+			WHERE movie_credits.person_id = $1 AND movies.deleted_at IS NULL
+			ORDER BY movies.year DESC,movies.id,movie_credits.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, personID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	credits := []*Credit{}
+	for rows.Next() {
+		credit := Credit{PersonID: personID, Movie: &Movie{}}
+		err = rows.Scan(append(
+			[]interface{}{&credit.ID, &credit.Role, &credit.Character, &credit.BillingOrder},
+			credit.Movie.scanFields()...,
+		)...)
+		if err != nil {
+			return nil, err
+		}
+		credit.MovieID = credit.Movie.ID
+		credits = append(credits, &credit)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return credits, nil
+}
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"github.com/lib/pq"
 	"time"
 )
@@ -23,17 +22,22 @@ func (p Permissions) Include(code string) bool {
 
 // 解耦数据库连接池
 type PermissionModel struct {
-	db *sql.DB
+	db dbtx
 }
 
-// 针对一个用户查找其所拥有的权限
+// 针对一个用户查找其所拥有的权限 包括直接授予的权限与通过角色获得的权限
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	stmt := `
 			SELECT permissions.code
 			FROM permissions
 			INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-			INNER JOIN users ON users_permissions.user_id = users.id
-			WHERE users.id = $1`
+			WHERE users_permissions.user_id = $1
+			UNION
+			SELECT permissions.code
+			FROM permissions
+			INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+			INNER JOIN user_roles ON user_roles.role_id = roles_permissions.role_id
+			WHERE user_roles.user_id = $1`
 	//创建五秒查操作超时
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	// 回收资源
@@ -47,7 +51,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	// 读取完毕后关闭资源(忘記寫defer過早關閉的了數據集導致讀取不到數據後續權限驗證失敗)
 	defer rows.Close()
 	// 创建自定义容器存储提取到的数据
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		// 創建容器存儲查詢到的數據
 		var permission string
@@ -80,3 +84,104 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.db.ExecContext(ctx, stmt, userID, pq.Array(codes))
 	return err
 }
+
+// 查询所有可用的权限代码
+func (m PermissionModel) GetAll() (Permissions, error) {
+	stmt := `SELECT code FROM permissions ORDER BY code`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err = rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// 由actorID代表的管理员為用戶授予權限 實際發生的變更會在同一條語句中寫入審計表
+func (m PermissionModel) Grant(actorID, userID int64, codes ...string) error {
+	stmt := `
+			WITH granted AS (
+				INSERT INTO users_permissions
+				SELECT $1,permissions.id FROM permissions WHERE permissions.code = ANY($2)
+				ON CONFLICT DO NOTHING
+				RETURNING permission_id
+			)
+			INSERT INTO permissions_audit(actor_id,user_id,permission,action)
+			SELECT $3,$1,permissions.code,'grant'
+			FROM granted
+			INNER JOIN permissions ON permissions.id = granted.permission_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, pq.Array(codes), actorID)
+	return err
+}
+
+// 由actorID代表的管理员撤銷用戶的權限 實際發生的變更會在同一條語句中寫入審計表
+func (m PermissionModel) Revoke(actorID, userID int64, codes ...string) error {
+	stmt := `
+			WITH revoked AS (
+				DELETE FROM users_permissions
+				USING permissions
+				WHERE users_permissions.permission_id = permissions.id
+				AND users_permissions.user_id = $1
+				AND permissions.code = ANY($2)
+				RETURNING permissions.code
+			)
+			INSERT INTO permissions_audit(actor_id,user_id,permission,action)
+			SELECT $3,$1,code,'revoke'
+			FROM revoked`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, pq.Array(codes), actorID)
+	return err
+}
+
+// 一条权限变更的审计记录
+type PermissionChange struct {
+	ActorID    *int64    `json:"actor_id"` // 操作者的账号被删除后为nil
+	Permission string    `json:"permission"`
+	Action     string    `json:"action"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// 列出某个用户所有的权限变更记录
+func (m PermissionModel) GetChangesForUser(userID int64) ([]*PermissionChange, error) {
+	stmt := `
+			SELECT actor_id,permission,action,created_at
+			FROM permissions_audit
+			WHERE user_id = $1
+			ORDER BY created_at,id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []*PermissionChange{}
+	for rows.Next() {
+		var change PermissionChange
+		err = rows.Scan(&change.ActorID, &change.Permission, &change.Action, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,262 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"time"
+)
+
+// 用户已经评论过这部电影
+var ErrDuplicateReview = errors.New("duplicate review")
+
+// 用户对电影的评分与评论
+type Review struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	MovieID   int64     `json:"movie_id"`
+	Score     int32     `json:"score"` // 1-10分
+	Body      string    `json:"body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+// 检查评论的内容
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Score >= 1 && review.Score <= 10, "score", "must be between 1 and 10")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+// 解耦数据库连接池
+type ReviewModel struct {
+	db dbtx
+}
+
+// 锁定电影的记录 同一部电影的评论变更因此串行执行 重新计算的评分不会遗漏并发提交的评论
+// 已经删除的电影不能再修改评论
+func lockMovie(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM movies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, movieID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// 重新计算电影的平均评分与评分人数
+func updateMovieRating(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	stmt := `
+			UPDATE movies
+			SET rating = stats.rating, votes = stats.votes
+			FROM (
+				SELECT COALESCE(avg(score),0) AS rating,count(*) AS votes
+				FROM reviews
+				WHERE movie_id = $1
+			) AS stats
+			WHERE movies.id = $1`
+	_, err := tx.ExecContext(ctx, stmt, movieID)
+	return err
+}
+
+// 在事务中执行对评论的修改并更新电影的评分
+func (m ReviewModel) withMovieRating(movieID int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	// 提交成功后Rollback不会产生任何影响
+	defer tx.Rollback()
+	err = lockMovie(ctx, tx, movieID)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
+	}
+	err = updateMovieRating(ctx, tx, movieID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 添加新的评论 电影不存在时返回ErrRecordNotFound
+func (m ReviewModel) Insert(review *Review) error {
+	stmt := `
+			INSERT INTO reviews(user_id,movie_id,score,body)
+			VALUES ($1,$2,$3,$4)
+			RETURNING id,created_at,updated_at,version`
+	return m.withMovieRating(review.MovieID, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, stmt, review.UserID, review.MovieID, review.Score, review.Body).
+			Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+		if err != nil {
+			var pqerr *pq.Error
+			if errors.As(err, &pqerr) && pqerr.Code == "23505" {
+				return ErrDuplicateReview
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+// 查询用户对电影的评论
+func (m ReviewModel) Get(userID, movieID int64) (*Review, error) {
+	stmt := `
+			SELECT reviews.id,reviews.user_id,users.name,reviews.movie_id,reviews.score,reviews.body,
+			       reviews.created_at,reviews.updated_at,reviews.version
+			FROM reviews
+			INNER JOIN users ON users.id = reviews.user_id
+			WHERE reviews.user_id = $1 AND reviews.movie_id = $2`
+	var review Review
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, userID, movieID).Scan(
+		&review.ID,
+		&review.UserID,
+		&review.UserName,
+		&review.MovieID,
+		&review.Score,
+		&review.Body,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &review, nil
+}
+
+// 更新评论(乐观锁)
+func (m ReviewModel) Update(review *Review) error {
+	stmt := `
+			UPDATE reviews
+			SET score = $1,body = $2,updated_at = NOW(),version = version + 1
+			WHERE id = $3 AND version = $4
+			RETURNING updated_at,version`
+	return m.withMovieRating(review.MovieID, func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, stmt, review.Score, review.Body, review.ID, review.Version).
+			Scan(&review.UpdatedAt, &review.Version)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return err
+	})
+}
+
+// 删除用户对电影的评论
+func (m ReviewModel) Delete(userID, movieID int64) error {
+	return m.withMovieRating(movieID, func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `DELETE FROM reviews WHERE user_id = $1 AND movie_id = $2`, userID, movieID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+// 列出电影的评论 返回当前页的数据与分页信息
+func (m ReviewModel) GetAllForMovie(movieID int64, filters Filters) ([]*Review, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),reviews.id,reviews.user_id,users.name,reviews.movie_id,reviews.score,reviews.body,
+		       reviews.created_at,reviews.updated_at,reviews.version
+		FROM reviews
+		INNER JOIN users ON users.id = reviews.user_id
+		WHERE reviews.movie_id = $1
+		ORDER BY reviews.%s %s,reviews.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	reviews := []*Review{}
+	totalRows := 0
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&totalRows,
+			&review.ID,
+			&review.UserID,
+			&review.UserName,
+			&review.MovieID,
+			&review.Score,
+			&review.Body,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return reviews, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 列出用户的所有评论 用于导出用户的数据
+func (m ReviewModel) GetAllForUser(userID int64) ([]*Review, error) {
+	stmt := `
+			SELECT reviews.id,reviews.user_id,users.name,reviews.movie_id,reviews.score,reviews.body,
+			       reviews.created_at,reviews.updated_at,reviews.version
+			FROM reviews
+			INNER JOIN users ON users.id = reviews.user_id
+			WHERE reviews.user_id = $1
+			ORDER BY reviews.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err = rows.Scan(
+			&review.ID,
+			&review.UserID,
+			&review.UserName,
+			&review.MovieID,
+			&review.Score,
+			&review.Body,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
@@ -0,0 +1,288 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+	ErrBuiltinRole       = errors.New("builtin role")
+)
+
+// 角色名称只允许小写字母 数字 下划线与短横线
+var roleNameRX = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// 角色是一组权限代码的集合
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Builtin     bool        `json:"builtin"` // 内置角色不能被删除或重命名
+	Version     int32       `json:"version"`
+}
+
+// 解耦数据库连接池
+type RoleModel struct {
+	db dbtx
+}
+
+// 检查角色的各个字段是否有效
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 50, "name", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(role.Name, roleNameRX), "name", "must only contain lowercase letters, digits, '_' and '-'")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// 查询角色时使用的公共语句 使用LEFT JOIN保证没有权限的角色也能被查询到
+const selectRoles = `
+			SELECT roles.id,roles.created_at,roles.name,roles.description,roles.builtin,roles.version,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL),'{}')
+			FROM roles
+			LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+			LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id`
+
+// 从查询结果中读取角色
+func scanRole(row interface{ Scan(...interface{}) error }) (*Role, error) {
+	var role Role
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.Builtin,
+		&role.Version,
+		pq.Array((*[]string)(&role.Permissions)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// 替换角色拥有的权限
+func setRolePermissions(ctx context.Context, tx *sql.Tx, roleID int64, permissions Permissions) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, roleID)
+	if err != nil {
+		return err
+	}
+	stmt := `
+			INSERT INTO roles_permissions
+			SELECT $1,permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	_, err = tx.ExecContext(ctx, stmt, roleID, pq.Array([]string(permissions)))
+	return err
+}
+
+// 判断错误是否是由于角色名称重复造成的
+func isDuplicateRoleName(err error) bool {
+	var pqerr *pq.Error
+	return errors.As(err, &pqerr) && pqerr.Code == "23505" && pqerr.Constraint == "roles_name_key"
+}
+
+// 创建新的角色
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := `
+			INSERT INTO roles(name,description)
+			VALUES ($1,$2)
+			RETURNING id,created_at,version`
+	err = tx.QueryRowContext(ctx, stmt, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		if isDuplicateRoleName(err) {
+			return ErrDuplicateRoleName
+		}
+		return err
+	}
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 根据ID查询角色
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	role, err := scanRole(m.db.QueryRowContext(ctx, selectRoles+`
+			WHERE roles.id = $1
+			GROUP BY roles.id`, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return role, nil
+}
+
+// 查询所有的角色
+func (m RoleModel) GetAll() ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, selectRoles+`
+			GROUP BY roles.id
+			ORDER BY roles.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// 查询用户拥有的所有角色
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, selectRoles+`
+			WHERE roles.id IN (SELECT role_id FROM user_roles WHERE user_id = $1)
+			GROUP BY roles.id
+			ORDER BY roles.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// 更新角色的信息与权限(乐观锁)
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := `
+			UPDATE roles
+			SET name = $1,description = $2,version = version + 1
+			WHERE id = $3 AND version = $4
+			RETURNING version`
+	err = tx.QueryRowContext(ctx, stmt, role.Name, role.Description, role.ID, role.Version).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case isDuplicateRoleName(err):
+			return ErrDuplicateRoleName
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 删除角色 内置角色不能被删除
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var builtin bool
+	stmt := `DELETE FROM roles WHERE id = $1 AND builtin = false RETURNING builtin`
+	err := m.db.QueryRowContext(ctx, stmt, id).Scan(&builtin)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// 没有删除任何记录 区分角色不存在与内置角色
+		err = m.db.QueryRowContext(ctx, `SELECT builtin FROM roles WHERE id = $1`, id).Scan(&builtin)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case err != nil:
+			return err
+		default:
+			return ErrBuiltinRole
+		}
+	}
+	return nil
+}
+
+// 由actorID代表的管理员为用户分配角色 变更会以role:<name>的形式写入审计表
+func (m RoleModel) AddForUser(actorID, userID int64, names ...string) error {
+	stmt := `
+			WITH added AS (
+				INSERT INTO user_roles
+				SELECT $1,roles.id FROM roles WHERE roles.name = ANY($2)
+				ON CONFLICT DO NOTHING
+				RETURNING role_id
+			)
+			INSERT INTO permissions_audit(actor_id,user_id,permission,action)
+			SELECT $3,$1,'role:' || roles.name,'grant'
+			FROM added
+			INNER JOIN roles ON roles.id = added.role_id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, pq.Array(names), actorID)
+	return err
+}
+
+// 由actorID代表的管理员移除用户的角色 变更会以role:<name>的形式写入审计表
+func (m RoleModel) RemoveForUser(actorID, userID int64, names ...string) error {
+	stmt := `
+			WITH removed AS (
+				DELETE FROM user_roles
+				USING roles
+				WHERE user_roles.role_id = roles.id
+				AND user_roles.user_id = $1
+				AND roles.name = ANY($2)
+				RETURNING roles.name
+			)
+			INSERT INTO permissions_audit(actor_id,user_id,permission,action)
+			SELECT $3,$1,'role:' || name,'revoke'
+			FROM removed`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, pq.Array(names), actorID)
+	return err
+}
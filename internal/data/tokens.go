@@ -6,14 +6,22 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"greenlight.vdebu.net/internal/validator"
 	"time"
 )
 
+// 刷新Token被重复使用时返回的错误
+var ErrTokenReused = errors.New("token reused")
+
 // 定义tokens可以作用的范围
 var (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa_pending"  // 密码验证通过但还需要提供二次验证码
+	ScopeEmailChange    = "email-change" // 确认新的邮箱地址
 )
 
 // 定义结构体用于存储Token的相关信息(增加输出token的tag -> 验证用户信息的有效性后返回API秘钥)
@@ -23,11 +31,24 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    string    `json:"-"` // 同一次登录生成的Token共享的链标识
+	UserAgent string    `json:"-"` // 创建Token时客户端的User-Agent
+	IP        string    `json:"-"` // 创建Token时客户端的IP
+}
+
+// 展示给用户的会话信息 使用不包含秘密信息的ID标识会话
+type Session struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"` // 是否是发起当前请求的会话
 }
 
 // Token数据模型解耦数据库相关的操作
 type TokenModel struct {
-	db *sql.DB
+	db dbtx
 }
 
 // 生成Token
@@ -48,13 +69,46 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	// 将随机填充的bytes转换成字符串
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	// 生成SHA-256的哈希
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	// 返回的是一个长度为32的数组 将其转换成切片
-	token.Hash = hash[:]
+	token.Hash = TokenHash(token.Plaintext)
 	// 返回生成好的token
 	return token, nil
 }
 
+// 计算Token明文的SHA-256哈希 数据库中只存储哈希
+func TokenHash(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	// 返回的是一个长度为32的数组 将其转换成切片
+	return hash[:]
+}
+
+// 生成认证Token与刷新Token 两者属于同一条Token链
+func generateTokenPair(userID int64, accessTTL, refreshTTL time.Duration, family, userAgent, ip string) (*Token, *Token, error) {
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, token := range []*Token{access, refresh} {
+		token.Family = family
+		token.UserAgent = userAgent
+		token.IP = ip
+	}
+	return access, refresh, nil
+}
+
+// 生成随机的Token链标识
+func generateFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // 对未哈希的密码进行基础检测
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
@@ -76,10 +130,10 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 // 向数据库中插入新的Token
 func (m TokenModel) Insert(token *Token) error {
 	stmt := `
-			INSERT INTO tokens(hash,user_id,expiry,scope)
-			VALUES ($1,$2,$3,$4)`
+			INSERT INTO tokens(hash,user_id,expiry,scope,family,user_agent,ip)
+			VALUES ($1,$2,$3,$4,$5,$6,$7)`
 	// 载入要插入的参数
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.UserAgent, token.IP}
 	// 设置五秒的操作超时
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	// 回收资源
@@ -91,15 +145,247 @@ func (m TokenModel) Insert(token *Token) error {
 	return err
 }
 
-// 针对某个用户删除其作用域下的所有Token
+// 针对某个用户删除其作用域下的所有Token 被删除的认证Token会同时写入撤销列表
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	stmt := `
-			DELETE FROM tokens
-			WHERE scope = $1 AND user_id = $2`
+			WITH deleted AS (
+				DELETE FROM tokens
+				WHERE scope = $1 AND user_id = $2
+				RETURNING hash,expiry,scope
+			)
+			INSERT INTO token_denylist(hash,expiry)
+			SELECT hash,expiry FROM deleted WHERE scope = $3
+			ON CONFLICT DO NOTHING`
 	// 设置五秒操作超时
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	// 回收资源
 	defer cancel()
-	_, err := m.db.ExecContext(ctx, stmt, scope, userID)
+	_, err := m.db.ExecContext(ctx, stmt, scope, userID, ScopeAuthentication)
 	return err
 }
+
+// 登录成功后创建新的Token链 返回认证Token与刷新Token
+func (m TokenModel) NewPair(userID int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	family, err := generateFamily()
+	if err != nil {
+		return nil, nil, err
+	}
+	access, refresh, err := generateTokenPair(userID, accessTTL, refreshTTL, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// 使用事务保证两个Token同时写入
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 提交成功后Rollback不会产生任何影响
+	defer tx.Rollback()
+	err = insertTokens(ctx, tx, access, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// 使用刷新Token换取新的Token 旧的刷新Token会被标记为已使用
+// 如果传入的刷新Token已经被使用过 则撤销整条Token链并返回ErrTokenReused
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tx, err := beginTx(ctx, m.db)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	// 锁定当前的刷新Token 防止并发的刷新请求同时通过检查
+	stmt := `
+			SELECT user_id,family,used
+			FROM tokens
+			WHERE hash = $1 AND scope = $2 AND expiry > $3
+			FOR UPDATE`
+	var (
+		userID int64
+		family string
+		used   bool
+	)
+	err = tx.QueryRowContext(ctx, stmt, tokenHash[:], ScopeRefresh, time.Now()).Scan(&userID, &family, &used)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	// 已经使用过的刷新Token再次出现说明可能被盗用 撤销整条链上的所有Token
+	if used {
+		stmt = `
+			WITH deleted AS (
+				DELETE FROM tokens WHERE family = $1 RETURNING hash,expiry,scope
+			)
+			INSERT INTO token_denylist(hash,expiry)
+			SELECT hash,expiry FROM deleted WHERE scope = $2
+			ON CONFLICT DO NOTHING`
+		_, err = tx.ExecContext(ctx, stmt, family, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+	// 标记旧的刷新Token为已使用
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used = true WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	// 在同一条链上生成新的Token
+	access, refresh, err := generateTokenPair(userID, accessTTL, refreshTTL, family, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = insertTokens(ctx, tx, access, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// 在事务中批量插入Token
+func insertTokens(ctx context.Context, tx *sql.Tx, tokens ...*Token) error {
+	stmt := `
+			INSERT INTO tokens(hash,user_id,expiry,scope,family,user_agent,ip)
+			VALUES ($1,$2,$3,$4,$5,$6,$7)`
+	for _, token := range tokens {
+		_, err := tx.ExecContext(ctx, stmt, token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.UserAgent, token.IP)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 撤销哈希对应的Token及其所在的整条Token链(登出) 被删除的认证Token会同时写入撤销列表
+func (m TokenModel) Revoke(tokenHash []byte) error {
+	stmt := `
+			WITH deleted AS (
+				DELETE FROM tokens
+				WHERE hash = $1
+				OR (family <> '' AND family = (SELECT family FROM tokens WHERE hash = $1))
+				RETURNING hash,expiry,scope
+			)
+			INSERT INTO token_denylist(hash,expiry)
+			SELECT hash,expiry FROM deleted WHERE scope = $2
+			ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, tokenHash, ScopeAuthentication)
+	return err
+}
+
+// 列出用户所有仍然有效的认证会话 currentHash用于标记发起请求的会话
+func (m TokenModel) GetSessionsForUser(userID int64, currentHash []byte) ([]*Session, error) {
+	stmt := `
+			SELECT id,created_at,expiry,user_agent,ip,COALESCE(hash = $4,false)
+			FROM tokens
+			WHERE user_id = $1 AND scope = $2 AND expiry > $3
+			ORDER BY created_at DESC,id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID, ScopeAuthentication, time.Now(), currentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// 根据会话ID撤销用户的某个会话(连同其所在的整条Token链)
+func (m TokenModel) RevokeSession(userID, sessionID int64) error {
+	if sessionID < 1 {
+		return ErrRecordNotFound
+	}
+	stmt := `
+			WITH deleted AS (
+				DELETE FROM tokens
+				WHERE user_id = $1
+				AND ((id = $2 AND scope = $3)
+				OR (family <> '' AND family = (SELECT family FROM tokens WHERE id = $2 AND user_id = $1 AND scope = $3)))
+				RETURNING hash,expiry,scope
+			), denied AS (
+				INSERT INTO token_denylist(hash,expiry)
+				SELECT hash,expiry FROM deleted WHERE scope = $3
+				ON CONFLICT DO NOTHING
+			)
+			SELECT count(*) FROM deleted`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var rowsAffected int64
+	err := m.db.QueryRowContext(ctx, stmt, userID, sessionID, ScopeAuthentication).Scan(&rowsAffected)
+	if err != nil {
+		return err
+	}
+	// 没有删除任何记录说明会话不存在或不属于当前用户
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 撤销用户除当前会话(所在的Token链)以外的所有会话 currentHash为nil时撤销全部会话
+func (m TokenModel) RevokeOtherSessions(userID int64, currentHash []byte) error {
+	stmt := `
+			WITH current AS (
+				SELECT hash,family FROM tokens WHERE hash = $2 AND user_id = $1
+			), deleted AS (
+				DELETE FROM tokens
+				WHERE user_id = $1 AND scope IN ($3,$4)
+				AND hash NOT IN (SELECT hash FROM current)
+				AND (family = '' OR family NOT IN (SELECT family FROM current))
+				RETURNING hash,expiry,scope
+			)
+			INSERT INTO token_denylist(hash,expiry)
+			SELECT hash,expiry FROM deleted WHERE scope = $3
+			ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, stmt, userID, currentHash, ScopeAuthentication, ScopeRefresh)
+	return err
+}
+
+// 删除所有已经过期的Token 返回删除的数量
+// 过期的Token本身就会被拒绝 刷新Token过期后也不再需要检测重复使用
+func (m TokenModel) DeleteExpired(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM tokens WHERE expiry <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
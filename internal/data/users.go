@@ -5,17 +5,23 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/lib/pq"
 
 	"golang.org/x/crypto/bcrypt"
 	"greenlight.vdebu.net/internal/validator"
+	"regexp"
 	"time"
+	_ "time/tzdata" // 内嵌时区数据 alpine镜像中没有安装tzdata
 )
 
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// 简单匹配BCP 47语言标签 例如en、zh-CN、zh-Hant-TW
+var LocaleRX = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
 // 创建一个空的用户用于标记当前用户的权限状态
 var AnonymousUser = &User{}
 
@@ -28,6 +34,35 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// 用户可以自行修改的资料
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Locale      string `json:"locale"`   // BCP 47 语言标签 例如zh-CN
+	Timezone    string `json:"timezone"` // IANA 时区 例如Asia/Shanghai
+	// 账号计划被删除的时间 为nil时表示没有申请删除
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+}
+
+// 查询用户时使用的字段 顺序与scanFields返回的一致
+const userColumns = `users.id,users.created_at,users.name,users.email,users.password_hash,users.activated,users.version,
+			users.display_name,users.bio,users.locale,users.timezone,users.deletion_scheduled_at`
+
+// 返回用于Scan的字段指针 与userColumns的顺序一致
+func (u *User) scanFields() []interface{} {
+	return []interface{}{
+		&u.ID,
+		&u.CreatedAt,
+		&u.Name,
+		&u.Email,
+		&u.Password.hash,
+		&u.Activated,
+		&u.Version,
+		&u.DisplayName,
+		&u.Bio,
+		&u.Locale,
+		&u.Timezone,
+		&u.DeletionScheduledAt,
+	}
 }
 
 // 检查当前用户是否是匿名用户
@@ -43,7 +78,7 @@ type password struct {
 
 // 用户的数据库连接池模型
 type UserModel struct {
-	db *sql.DB
+	db dbtx
 }
 
 // 将输入的密码进行哈希并赋值给当前传入的password结构体
@@ -92,6 +127,19 @@ func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
 	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
 }
+
+// 检查用户可以自行修改的资料
+func ValidateProfile(v *validator.Validator, user *User) {
+	v.Check(len(user.DisplayName) <= 100, "display_name", "must not be more than 100 bytes long")
+	v.Check(len(user.Bio) <= 1000, "bio", "must not be more than 1000 bytes long")
+	// 语言与时区允许为空 表示使用客户端的默认值
+	v.Check(user.Locale == "" || validator.Matches(user.Locale, LocaleRX), "locale", "must be a valid BCP 47 language tag")
+	if user.Timezone != "" {
+		_, err := time.LoadLocation(user.Timezone)
+		v.Check(err == nil && user.Timezone != "Local", "timezone", "must be a valid IANA time zone")
+	}
+}
+
 func ValidateUser(v *validator.Validator, user *User) {
 	// 名称不为空
 	v.Check(user.Name != "", "name", "must be provided")
@@ -99,6 +147,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 	// 邮箱的有效性
 	ValidateEmail(v, user.Email)
+	// 资料的有效性
+	ValidateProfile(v, user)
 	// 若密码不为nil ->用户进行了输入 对有效性进行判断
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
@@ -109,6 +159,14 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 
 }
+
+// 检查错误是否是由于邮箱违反唯一约束(citext 不区分大小写)造成的
+func isDuplicateEmail(err error) bool {
+	// 表示postgresql报的错误
+	var pqerr *pq.Error
+	return errors.As(err, &pqerr) && pqerr.Code == "23505" && pqerr.Constraint == "users_email_key"
+}
+
 func (m *UserModel) Insert(user *User) error {
 	stmt := `
 			INSERT INTO users(name,email,password_hash,activated)
@@ -125,7 +183,7 @@ func (m *UserModel) Insert(user *User) error {
 	if err != nil {
 		switch {
 		// 检查错误是不是由于重复插入email造成的
-		case err.Error() == `pq:duplicate key value violate unique constraint "user_email_key"`:
+		case isDuplicateEmail(err):
 			return ErrDuplicateEmail
 		default:
 			return err
@@ -135,10 +193,35 @@ func (m *UserModel) Insert(user *User) error {
 	return nil
 }
 
+// 通过用户ID查询用户的具体信息
+func (m *UserModel) Get(id int64) (*User, error) {
+	// 避免进行不必要的数据库查询
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	stmt := `
+			SELECT ` + userColumns + `
+			FROM users
+			WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, id).Scan(user.scanFields()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // 通过提供的email查询用户的具体信息
 func (m *UserModel) GetByEmail(email string) (*User, error) {
 	stmt := `
-			SELECT id,created_at,name,email,password_hash,activated,version
+			SELECT ` + userColumns + `
 			FROM users
 			WHERE email = $1`
 	// 创建结构体存储查询到的信息
@@ -146,15 +229,7 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 	// 设置五秒操作超时
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	err := m.db.QueryRowContext(ctx, stmt, email).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := m.db.QueryRowContext(ctx, stmt, email).Scan(user.scanFields()...)
 	if err != nil {
 		switch {
 		// 判断是否查无此人
@@ -172,8 +247,9 @@ func (m *UserModel) GetByEmail(email string) (*User, error) {
 func (m *UserModel) Update(user *User) error {
 	stmt := `
 			UPDATE users
-			SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-			WHERE id = $5  AND  version = $6
+			SET name = $1, email = $2, password_hash = $3, activated = $4,
+			    display_name = $5, bio = $6, locale = $7, timezone = $8, version = version + 1
+			WHERE id = $9  AND  version = $10
 			RETURNING version`
 	// 载入用于更新的信息
 	args := []interface{}{
@@ -181,6 +257,10 @@ func (m *UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.DisplayName,
+		user.Bio,
+		user.Locale,
+		user.Timezone,
 		user.ID,
 		user.Version,
 	}
@@ -190,15 +270,10 @@ func (m *UserModel) Update(user *User) error {
 	// 同时更新当前user的version
 	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(&user.Version)
 	if err != nil {
-		// 表示postgresql报的错误
-		var pqerr *pq.Error
 		switch {
-		// 检查错误类型是否是由于唯一约束造成的
-		case errors.As(err, &pqerr):
-			if pqerr.Code == "23505" {
-				// 违反唯一约束
-				return ErrDuplicateEmail
-			}
+		// 检查错误类型是否是由于邮箱的唯一约束造成的
+		case isDuplicateEmail(err):
+			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			// 永远都是现提取用户所有的信息再用于更新数据库中的信息
 			// 如果后续update没有查询到记录说明发生了EditConflict
@@ -216,7 +291,7 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// 查找条件匹配的用户数据
 	stmt := `
-			SELECT users.id,users.created_at,users.name,users.email,users.password_hash,users.activated,users.version
+			SELECT ` + userColumns + `
 			FROM users
 			INNER JOIN tokens
 			ON users.id = tokens.user_id
@@ -232,15 +307,7 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 	// 回收资源
 	defer cancel()
 	// 执行查询语句
-	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.Name,
-		&user.Email,
-		&user.Password.hash,
-		&user.Activated,
-		&user.Version,
-	)
+	err := m.db.QueryRowContext(ctx, stmt, args...).Scan(user.scanFields()...)
 	if err != nil {
 		// 检查错误类型
 		switch {
@@ -254,3 +321,132 @@ func (m *UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error
 	// 查询成功
 	return &user, nil
 }
+
+// 计划在指定的时间删除用户的账号
+func (m *UserModel) ScheduleDeletion(user *User, at time.Time) error {
+	stmt := `
+			UPDATE users
+			SET deletion_scheduled_at = $1, version = version + 1
+			WHERE id = $2 AND version = $3
+			RETURNING version`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, at, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	user.DeletionScheduledAt = &at
+	return nil
+}
+
+// 取消计划中的账号删除 没有计划中的删除时返回ErrRecordNotFound
+func (m *UserModel) CancelDeletion(userID int64) error {
+	stmt := `
+			UPDATE users
+			SET deletion_scheduled_at = NULL, version = version + 1
+			WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 删除所有计划删除时间已到的账号 返回删除的数量
+// 关联的数据通过外键级联删除 审计记录中的用户ID被置空 认证Token在删除前写入撤销列表
+// 被删除的评论不再计入电影的评分
+func (m *UserModel) DeleteScheduled(now time.Time) (int64, error) {
+	stmt := `
+			WITH expired AS (
+				SELECT id,email FROM users
+				WHERE deletion_scheduled_at <= $1
+			), ratings AS (
+				UPDATE movies
+				SET rating = stats.rating, votes = stats.votes
+				FROM (
+					SELECT affected.movie_id,COALESCE(avg(reviews.score),0) AS rating,count(reviews.id) AS votes
+					FROM (SELECT DISTINCT movie_id FROM reviews WHERE user_id IN (SELECT id FROM expired)) AS affected
+					LEFT JOIN reviews ON reviews.movie_id = affected.movie_id
+					AND reviews.user_id NOT IN (SELECT id FROM expired)
+					GROUP BY affected.movie_id
+				) AS stats
+				WHERE movies.id = stats.movie_id
+			), denied AS (
+				INSERT INTO token_denylist(hash,expiry)
+				SELECT hash,expiry FROM tokens
+				WHERE user_id IN (SELECT id FROM expired) AND scope = $2
+				ON CONFLICT DO NOTHING
+			), failures AS (
+				DELETE FROM auth_failures
+				WHERE kind = $3 AND subject IN (SELECT lower(email::text) FROM expired)
+			), deleted AS (
+				DELETE FROM users
+				WHERE id IN (SELECT id FROM expired)
+				RETURNING id
+			)
+			SELECT count(*) FROM deleted`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var deleted int64
+	err := m.db.QueryRowContext(ctx, stmt, now, ScopeAuthentication, LockoutAccount).Scan(&deleted)
+	return deleted, err
+}
+
+// 删除未激活账号的语句 %s为筛选账号的条件 使用$1作为参数
+// 未激活的账号同样可以登录 认证Token在删除前写入撤销列表
+const deleteUnactivatedStmt = `
+			WITH expired AS (
+				SELECT id,email FROM users
+				WHERE activated = false AND %s
+			), denied AS (
+				INSERT INTO token_denylist(hash,expiry)
+				SELECT hash,expiry FROM tokens
+				WHERE user_id IN (SELECT id FROM expired) AND scope = $2
+				ON CONFLICT DO NOTHING
+			), failures AS (
+				DELETE FROM auth_failures
+				WHERE kind = $3 AND subject IN (SELECT lower(email::text) FROM expired)
+			), deleted AS (
+				DELETE FROM users
+				WHERE id IN (SELECT id FROM expired)
+				RETURNING id
+			)
+			SELECT count(*) FROM deleted`
+
+// 删除在before之前注册且一直没有激活的账号 返回删除的数量
+func (m *UserModel) DeleteUnactivated(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var deleted int64
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf(deleteUnactivatedStmt, "created_at < $1"), before, ScopeAuthentication, LockoutAccount).Scan(&deleted)
+	return deleted, err
+}
+
+// 删除指定的未激活账号 账号不存在或已经激活时返回ErrRecordNotFound
+func (m *UserModel) DeleteIfUnactivated(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var deleted int64
+	err := m.db.QueryRowContext(ctx, fmt.Sprintf(deleteUnactivatedStmt, "id = $1"), id, ScopeAuthentication, LockoutAccount).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
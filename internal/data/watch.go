@@ -0,0 +1,248 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.vdebu.net/internal/validator"
+	"time"
+)
+
+// 想看列表中的一部电影
+type WatchlistEntry struct {
+	Movie   *Movie    `json:"movie"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// 一条观看记录
+type HistoryEntry struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	MovieID   int64     `json:"-"`
+	Movie     *Movie    `json:"movie,omitempty"`
+	WatchedAt time.Time `json:"watched_at"`
+	Rating    *int32    `json:"rating,omitempty"` // 观看时的个人评分 1-10分 可选
+}
+
+// 检查观看记录
+func ValidateHistoryEntry(v *validator.Validator, entry *HistoryEntry) {
+	v.Check(entry.MovieID > 0, "movie_id", "must be provided")
+	v.Check(!entry.WatchedAt.After(time.Now()), "watched_at", "must not be in the future")
+	if entry.Rating != nil {
+		v.Check(*entry.Rating >= 1 && *entry.Rating <= 10, "rating", "must be between 1 and 10")
+	}
+}
+
+// 引用的电影不存在
+func isMissingMovie(err error) bool {
+	var pqerr *pq.Error
+	return errors.As(err, &pqerr) && pqerr.Code == "23503"
+}
+
+// 解耦数据库连接池
+type WatchModel struct {
+	db dbtx
+}
+
+// 将电影加入想看列表 已经在列表中时保持原来的加入时间
+// 电影不存在或已经被删除时返回ErrRecordNotFound
+func (m WatchModel) AddToWatchlist(userID, movieID int64) (time.Time, error) {
+	stmt := `
+			INSERT INTO watchlist(user_id,movie_id)
+			SELECT $1,id FROM movies WHERE id = $2 AND deleted_at IS NULL
+			ON CONFLICT (user_id,movie_id) DO UPDATE SET added_at = watchlist.added_at
+			RETURNING added_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var addedAt time.Time
+	err := m.db.QueryRowContext(ctx, stmt, userID, movieID).Scan(&addedAt)
+	if errors.Is(err, sql.ErrNoRows) || isMissingMovie(err) {
+		return time.Time{}, ErrRecordNotFound
+	}
+	return addedAt, err
+}
+
+// 将电影从想看列表中移除
+func (m WatchModel) RemoveFromWatchlist(userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM watchlist WHERE user_id = $1 AND movie_id = $2`, userID, movieID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 列出用户的想看列表 返回当前页的数据与分页信息
+func (m WatchModel) GetWatchlist(userID int64, filters Filters) ([]*WatchlistEntry, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),watchlist.added_at,`+movieColumns+`
+		FROM watchlist
+		INNER JOIN movies ON movies.id = watchlist.movie_id
+		WHERE watchlist.user_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY %s %s,movies.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	entries := []*WatchlistEntry{}
+	totalRows := 0
+	for rows.Next() {
+		entry := WatchlistEntry{Movie: &Movie{}}
+		err := rows.Scan(append([]interface{}{&totalRows, &entry.AddedAt}, entry.Movie.scanFields()...)...)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return entries, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 添加一条观看记录 电影不存在或已经被删除时返回ErrRecordNotFound
+func (m WatchModel) AddToHistory(entry *HistoryEntry) error {
+	stmt := `
+			INSERT INTO watch_history(user_id,movie_id,watched_at,rating)
+			SELECT $1,id,$3,$4 FROM movies WHERE id = $2 AND deleted_at IS NULL
+			RETURNING id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.db.QueryRowContext(ctx, stmt, entry.UserID, entry.MovieID, entry.WatchedAt, entry.Rating).Scan(&entry.ID)
+	if errors.Is(err, sql.ErrNoRows) || isMissingMovie(err) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// 删除用户的一条观看记录
+func (m WatchModel) DeleteFromHistory(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.db.ExecContext(ctx, `DELETE FROM watch_history WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// 列出用户的观看记录 返回当前页的数据与分页信息
+func (m WatchModel) GetHistory(userID int64, filters Filters) ([]*HistoryEntry, MetaData, error) {
+	stmt := fmt.Sprintf(`
+		SELECT count(*) OVER(),watch_history.id,watch_history.watched_at,watch_history.rating,`+movieColumns+`
+		FROM watch_history
+		INNER JOIN movies ON movies.id = watch_history.movie_id
+		WHERE watch_history.user_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY %s %s,watch_history.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, MetaData{}, err
+	}
+	defer rows.Close()
+	entries := []*HistoryEntry{}
+	totalRows := 0
+	for rows.Next() {
+		entry := HistoryEntry{UserID: userID, Movie: &Movie{}}
+		err := rows.Scan(append(
+			[]interface{}{&totalRows, &entry.ID, &entry.WatchedAt, &entry.Rating},
+			entry.Movie.scanFields()...,
+		)...)
+		if err != nil {
+			return nil, MetaData{}, err
+		}
+		entry.MovieID = entry.Movie.ID
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, MetaData{}, err
+	}
+	return entries, calculateMetadata(totalRows, filters.Page, filters.PageSize), nil
+}
+
+// 按观看时间列出用户所有的观看记录 用于导出
+func (m WatchModel) GetAllHistory(userID int64) ([]*HistoryEntry, error) {
+	stmt := `
+			SELECT watch_history.id,watch_history.watched_at,watch_history.rating,` + movieColumns + `
+			FROM watch_history
+			INNER JOIN movies ON movies.id = watch_history.movie_id
+			WHERE watch_history.user_id = $1
+			ORDER BY watch_history.watched_at,watch_history.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*HistoryEntry{}
+	for rows.Next() {
+		entry := HistoryEntry{UserID: userID, Movie: &Movie{}}
+		err = rows.Scan(append([]interface{}{&entry.ID, &entry.WatchedAt, &entry.Rating}, entry.Movie.scanFields()...)...)
+		if err != nil {
+			return nil, err
+		}
+		entry.MovieID = entry.Movie.ID
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// 按加入时间列出用户想看列表中所有的电影 用于导出
+func (m WatchModel) GetAllWatchlist(userID int64) ([]*WatchlistEntry, error) {
+	stmt := `
+			SELECT watchlist.added_at,` + movieColumns + `
+			FROM watchlist
+			INNER JOIN movies ON movies.id = watchlist.movie_id
+			WHERE watchlist.user_id = $1
+			ORDER BY watchlist.added_at,movies.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []*WatchlistEntry{}
+	for rows.Next() {
+		entry := WatchlistEntry{Movie: &Movie{}}
+		err = rows.Scan(append([]interface{}{&entry.AddedAt}, entry.Movie.scanFields()...)...)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
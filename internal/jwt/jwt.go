@@ -0,0 +1,141 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 支持的签名算法
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// 验证失败时返回的错误 调用方不需要区分具体原因
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// JWT的头部
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// 签发给用户的声明 除了标准字段外还包含认证中间件需要的用户信息 避免每次请求都查询数据库
+type Claims struct {
+	Subject   int64  `json:"sub"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Activated bool   `json:"activated"`
+}
+
+// 对声明进行签名 使用KeySet中指定的签名秘钥
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	key := ks.signing
+	// 编码头部与声明
+	h, err := json.Marshal(header{Alg: key.Alg, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	// 计算签名
+	signature, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// 验证JWT的签名与有效期 返回其中的声明
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	// JWT由三部分组成 header.claims.signature
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	// 解析头部 根据kid找到对应的秘钥
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var hdr header
+	if err = json.Unmarshal(h, &hdr); err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, ok := ks.keys[hdr.Kid]
+	// 头部声明的算法必须与秘钥的算法一致 防止算法混淆攻击
+	if !ok || hdr.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+	// 验证签名
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	// 签名有效后再解析声明
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err = json.Unmarshal(c, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	// 检查有效期
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// 使用秘钥对数据进行签名
+func (k *Key) sign(data []byte) ([]byte, error) {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case AlgEdDSA:
+		// 仅包含公钥的秘钥只能用于验证
+		if k.private == nil {
+			return nil, errors.New("jwt: key " + k.ID + " cannot be used for signing")
+		}
+		return ed25519.Sign(k.private, data), nil
+	default:
+		return nil, errors.New("jwt: unsupported algorithm " + k.Alg)
+	}
+}
+
+// 验证数据的签名
+func (k *Key) verify(data, signature []byte) bool {
+	switch k.Alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		// 使用常数时间比较防止时序攻击
+		return hmac.Equal(mac.Sum(nil), signature)
+	case AlgEdDSA:
+		return ed25519.Verify(k.public, data, signature)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,101 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// 用于签名或验证的秘钥 通过kid进行标识
+type Key struct {
+	ID      string
+	Alg     string
+	secret  []byte             // HS256使用的共享秘钥
+	private ed25519.PrivateKey // EdDSA的私钥 只保留公钥的旧秘钥为nil
+	public  ed25519.PublicKey  // EdDSA的公钥
+}
+
+// 秘钥集合 用于实现秘钥轮换: 使用指定的秘钥签名 使用集合中任意秘钥验证
+type KeySet struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// 从文件中载入秘钥
+// HS256: 文件内容即为共享秘钥(至少32字节)
+// EdDSA: PEM编码的PKCS8私钥 或PKIX公钥(仅用于验证已经退役的秘钥)
+func LoadKey(kid, alg, path string) (*Key, error) {
+	if kid == "" {
+		return nil, errors.New("jwt: key id must be provided")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ID: kid, Alg: alg}
+	switch alg {
+	case AlgHS256:
+		key.secret = bytes.TrimSpace(content)
+		if len(key.secret) < 32 {
+			return nil, fmt.Errorf("jwt: HS256 key %q must be at least 32 bytes long", kid)
+		}
+	case AlgEdDSA:
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("jwt: EdDSA key %q is not PEM encoded", kid)
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			private, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 private key", kid)
+			}
+			key.private = private
+			key.public = private.Public().(ed25519.PublicKey)
+		case "PUBLIC KEY":
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			public, ok := parsed.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 public key", kid)
+			}
+			key.public = public
+		default:
+			return nil, fmt.Errorf("jwt: unsupported PEM block %q in key %q", block.Type, kid)
+		}
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q for key %q", alg, kid)
+	}
+	return key, nil
+}
+
+// 创建秘钥集合 signingKID指定用于签发新Token的秘钥
+func NewKeySet(signingKID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	signing, ok := ks.keys[signingKID]
+	if !ok {
+		return nil, fmt.Errorf("jwt: signing key %q not found", signingKID)
+	}
+	// 签名秘钥必须包含私钥
+	if signing.Alg == AlgEdDSA && signing.private == nil {
+		return nil, fmt.Errorf("jwt: signing key %q has no private key", signingKID)
+	}
+	ks.signing = signing
+	return ks, nil
+}
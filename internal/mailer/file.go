@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 将邮件写入目录中的.eml文件 本地开发时可以用邮件客户端直接打开
+type File struct {
+	dir    string
+	sender string
+}
+
+// 创建新的文件发送者 目录不存在时会被创建
+func NewFile(dir, sender string) (*File, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &File{dir: dir, sender: sender}, nil
+}
+
+// 将邮件写入新的文件 文件名以时间开头 按名称排序即为发送顺序
+func (m *File) Send(recipient string, message *Message) error {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	// 先写入临时文件再重命名 读取者不会看到写了一半的邮件
+	tmp, err := os.CreateTemp(m.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = newMessage(m.sender, recipient, message).WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(m.dir, name))
+}
@@ -0,0 +1,25 @@
+package mailer
+
+import (
+	"greenlight.vdebu.net/internal/jsonlog"
+)
+
+// 将邮件输出到日志 不需要任何外部服务 邮件中的Token等内容可以直接在日志中查看
+type Log struct {
+	logger *jsonlog.Logger
+}
+
+// 创建新的日志发送者
+func NewLog(logger *jsonlog.Logger) *Log {
+	return &Log{logger: logger}
+}
+
+// 以INFO级别输出邮件的收件人、主题与纯文本内容
+func (m *Log) Send(recipient string, message *Message) error {
+	m.logger.PrintInfo("email", map[string]string{
+		"to":      recipient,
+		"subject": message.Subject,
+		"body":    message.PlainBody,
+	})
+	return nil
+}
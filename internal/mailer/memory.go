@@ -0,0 +1,46 @@
+package mailer
+
+import (
+	"sync"
+)
+
+// 保存在内存中的一封邮件
+type SentMessage struct {
+	Recipient string
+	Message
+}
+
+// 将邮件保存在内存中 用于测试时读取发送的邮件
+type Memory struct {
+	mu       sync.Mutex
+	messages []SentMessage
+}
+
+// 创建新的内存发送者
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// 保存邮件
+func (m *Memory) Send(recipient string, message *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, SentMessage{Recipient: recipient, Message: *message})
+	return nil
+}
+
+// 返回目前为止保存的所有邮件的副本
+func (m *Memory) Messages() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	messages := make([]SentMessage, len(m.messages))
+	copy(messages, m.messages)
+	return messages
+}
+
+// 清空保存的邮件
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryKeepsRenderedMessages(t *testing.T) {
+	m := NewMemory()
+	message, err := Render("token_activation.tmpl.html", map[string]interface{}{
+		"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send("alice@example.com", message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := m.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages; want 1", len(messages))
+	}
+	got := messages[0]
+	if got.Recipient != "alice@example.com" {
+		t.Errorf("got recipient %q; want %q", got.Recipient, "alice@example.com")
+	}
+	if got.Subject != "Activate your GreenLight account" {
+		t.Errorf("got subject %q", got.Subject)
+	}
+	for name, body := range map[string]string{"plain": got.PlainBody, "html": got.HTMLBody} {
+		if !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			t.Errorf("%s body does not contain the activation token", name)
+		}
+	}
+
+	// 返回的是副本 修改后不影响保存的邮件
+	messages[0].Recipient = "mallory@example.com"
+	if m.Messages()[0].Recipient != "alice@example.com" {
+		t.Error("Messages returned a shared slice")
+	}
+
+	m.Reset()
+	if n := len(m.Messages()); n != 0 {
+		t.Errorf("got %d messages after Reset; want 0", n)
+	}
+}
@@ -0,0 +1,28 @@
+package mailer
+
+import (
+	"github.com/go-mail/mail"
+	"time"
+)
+
+// 通过SMTP服务器发送邮件
+type SMTP struct {
+	dialer *mail.Dialer // 用于连接SMTP服务器
+	sender string       // 发件人的邮箱
+}
+
+// 创建新的SMTP发送者
+func NewSMTP(host string, port int, username, password, sender string) *SMTP {
+	// 根据给定的SMTP信息初始化dialer
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	return &SMTP{
+		dialer: dialer,
+		sender: sender,
+	}
+}
+
+// 连接SMTP服务器并发送邮件
+func (m *SMTP) Send(recipient string, message *Message) error {
+	return m.dialer.DialAndSend(newMessage(m.sender, recipient, message))
+}
@@ -0,0 +1,91 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// RFC 6238 的默认参数 与主流的验证器应用保持一致
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// 允许前后各一个时间窗口的误差 兼容客户端与服务器的时钟偏差
+	Skew = 1
+)
+
+// 密钥使用不带填充的base32编码 与otpauth URI的要求一致
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// 生成新的20字节随机密钥(HMAC-SHA1推荐的长度)
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// 将密钥编码成用户可以手动输入的字符串
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// 生成验证器应用可以识别的otpauth URI(通常以二维码的形式展示)
+func URI(issuer, account string, secret []byte) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period.Seconds())))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// 计算给定时间所在的时间窗口序号
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// 计算某个时间窗口的验证码(RFC 4226 HOTP)
+func codeForStep(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	// 动态截断 取最后一个字节的低四位作为偏移量
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1_000_000)
+}
+
+// 计算给定时间的验证码
+func Code(secret []byte, t time.Time) string {
+	return codeForStep(secret, Step(t))
+}
+
+// 检查验证码在给定时间是否有效 返回匹配的时间窗口序号
+// 调用方需要记录已经使用过的序号 防止同一个验证码被重复使用
+func Validate(secret []byte, code string, t time.Time) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for i := int64(-Skew); i <= Skew; i++ {
+		expected := codeForStep(secret, current+i)
+		// 使用常数时间比较防止时序攻击
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return current + i, true
+		}
+	}
+	return 0, false
+}
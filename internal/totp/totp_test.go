@@ -0,0 +1,84 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录B中HMAC-SHA1的测试向量
+// 附录中的验证码为8位 6位的验证码是其后6位(10^6整除10^8)
+// 本包只实现了SHA1 SHA256与SHA512的向量不适用
+var rfc6238Secret = []byte("12345678901234567890")
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		want := tt.code[len(tt.code)-Digits:]
+		got := Code(rfc6238Secret, time.Unix(tt.unix, 0))
+		if got != want {
+			t.Errorf("Code at %d: got %s; want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, tt := range rfc6238Vectors {
+		now := time.Unix(tt.unix, 0)
+		code := tt.code[len(tt.code)-Digits:]
+		step, ok := Validate(rfc6238Secret, code, now)
+		if !ok {
+			t.Errorf("Validate at %d: rejected %s", tt.unix, code)
+			continue
+		}
+		if step != Step(now) {
+			t.Errorf("Validate at %d: got step %d; want %d", tt.unix, step, Step(now))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := Code(rfc6238Secret, now)
+	tests := []struct {
+		name   string
+		offset time.Duration
+		ok     bool
+	}{
+		{"previous window", -Period, true},
+		{"next window", Period, true},
+		{"two windows behind", -2 * Period, false},
+		{"two windows ahead", 2 * Period, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 在offset之后验证now时的验证码 相当于客户端的时钟落后了offset
+			step, ok := Validate(rfc6238Secret, code, now.Add(tt.offset))
+			if ok != tt.ok {
+				t.Fatalf("got ok %v; want %v", ok, tt.ok)
+			}
+			if ok && step != Step(now) {
+				t.Errorf("got step %d; want %d", step, Step(now))
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "94287082", "287083"} {
+		if _, ok := Validate(rfc6238Secret, code, now); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+}
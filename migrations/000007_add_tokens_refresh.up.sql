@@ -0,0 +1,5 @@
+-- 同一次登录生成的认证Token与刷新Token共享同一个family 用于在刷新Token被重复使用时撤销整条链
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+-- 标记刷新Token是否已经被轮换使用过
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used bool NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens(family);
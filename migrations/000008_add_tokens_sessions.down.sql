@@ -0,0 +1,5 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS ip;
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
+ALTER TABLE tokens DROP CONSTRAINT IF EXISTS tokens_id_key;
+ALTER TABLE tokens DROP COLUMN IF EXISTS id;
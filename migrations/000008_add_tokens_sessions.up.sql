@@ -0,0 +1,7 @@
+-- 为Token添加不包含秘密信息的会话标识 Token.Hash永远不能离开服务器
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial;
+ALTER TABLE tokens ADD CONSTRAINT tokens_id_key UNIQUE (id);
+-- 记录会话的创建时间与客户端信息
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- 已撤销但尚未过期的认证Token 使用JWT时认证中间件不会查询tokens表 需要通过该表拒绝已撤销的Token
+CREATE TABLE IF NOT EXISTS token_denylist(
+    hash bytea PRIMARY KEY ,
+    expiry timestamp(0) with time zone NOT NULL
+);
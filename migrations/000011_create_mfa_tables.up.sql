@@ -0,0 +1,16 @@
+-- 用户的TOTP密钥 confirmed为false表示还没有通过第一次验证
+CREATE TABLE IF NOT EXISTS user_totp(
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE ,
+    secret bytea NOT NULL ,
+    confirmed bool NOT NULL DEFAULT false ,
+    last_used_step bigint NOT NULL DEFAULT 0 ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+-- 一次性的恢复码 只存储哈希
+CREATE TABLE IF NOT EXISTS user_recovery_codes(
+    id bigserial PRIMARY KEY ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    hash bytea NOT NULL ,
+    used_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_id_idx ON user_recovery_codes(user_id);
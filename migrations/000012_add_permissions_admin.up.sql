@@ -0,0 +1,14 @@
+-- 管理用户权限所需的权限
+INSERT INTO permissions(code)
+SELECT 'permissions:admin'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'permissions:admin');
+-- 记录每一次权限变更 操作者与目标用户被删除后仍然保留记录
+CREATE TABLE IF NOT EXISTS permissions_audit(
+    id bigserial PRIMARY KEY ,
+    actor_id bigint REFERENCES users ON DELETE SET NULL ,
+    user_id bigint REFERENCES users ON DELETE SET NULL ,
+    permission text NOT NULL ,
+    action text NOT NULL CHECK ( action IN ('grant','revoke') ) ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS permissions_audit_user_id_idx ON permissions_audit(user_id);
@@ -0,0 +1,33 @@
+-- 角色是一组权限代码的集合 用户通过角色间接获得权限
+CREATE TABLE IF NOT EXISTS roles(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    name text UNIQUE NOT NULL ,
+    description text NOT NULL DEFAULT '' ,
+    builtin bool NOT NULL DEFAULT false ,
+    version integer NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS roles_permissions(
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE ,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE ,
+    PRIMARY KEY (role_id,permission_id)
+);
+CREATE TABLE IF NOT EXISTS user_roles(
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE ,
+    PRIMARY KEY (user_id,role_id)
+);
+-- 内置角色
+INSERT INTO roles(name,description,builtin)
+VALUES
+    ('viewer','Read access to the movie catalogue',true),
+    ('editor','Read and write access to the movie catalogue',true),
+    ('admin','Full access including permission management',true)
+ON CONFLICT (name) DO NOTHING;
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movie:read')
+OR (roles.name = 'editor' AND permissions.code IN ('movie:read','movie:write'))
+OR roles.name = 'admin'
+ON CONFLICT DO NOTHING;
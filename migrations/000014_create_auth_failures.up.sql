@@ -0,0 +1,10 @@
+-- 按账号与按IP统计的登录失败次数 锁定状态存储在数据库中以便在重启后仍然有效
+CREATE TABLE IF NOT EXISTS auth_failures(
+    kind text NOT NULL CHECK ( kind IN ('account','ip') ) ,
+    subject text NOT NULL ,
+    failures integer NOT NULL DEFAULT 0 ,
+    lock_count integer NOT NULL DEFAULT 0 ,
+    locked_until timestamp(0) with time zone ,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    PRIMARY KEY (kind,subject)
+);
@@ -0,0 +1,6 @@
+-- 尚未确认的邮箱修改 每个用户同时只保留最新的一次修改
+CREATE TABLE IF NOT EXISTS email_changes(
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE ,
+    new_email citext NOT NULL ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
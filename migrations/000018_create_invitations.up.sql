@@ -0,0 +1,13 @@
+-- 管理员发出的注册邀请 被邀请者注册时会获得邀请中指定的角色与权限
+CREATE TABLE IF NOT EXISTS invitations(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    hash bytea UNIQUE NOT NULL ,
+    email citext NOT NULL ,
+    invited_by bigint REFERENCES users ON DELETE SET NULL ,
+    role_id bigint REFERENCES roles ON DELETE SET NULL ,
+    permissions text[] NOT NULL DEFAULT '{}' ,
+    expiry timestamp(0) with time zone NOT NULL ,
+    accepted_at timestamp(0) with time zone ,
+    user_id bigint REFERENCES users ON DELETE SET NULL
+);
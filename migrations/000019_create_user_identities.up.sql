@@ -0,0 +1,19 @@
+-- 外部身份提供方的账号与本地用户的关联
+CREATE TABLE IF NOT EXISTS user_identities(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    provider text NOT NULL ,
+    subject text NOT NULL ,
+    email text NOT NULL DEFAULT '' ,
+    UNIQUE (provider,subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
+-- 进行中的OIDC登录 回调时通过state找到对应的code_verifier与nonce
+CREATE TABLE IF NOT EXISTS oidc_states(
+    hash bytea PRIMARY KEY ,
+    provider text NOT NULL ,
+    code_verifier text NOT NULL ,
+    nonce text NOT NULL ,
+    expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,31 @@
+-- 第三方应用 机密客户端的秘钥只存储哈希 公共客户端没有秘钥
+CREATE TABLE IF NOT EXISTS oauth_clients(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    client_id text UNIQUE NOT NULL ,
+    secret_hash bytea ,
+    name text NOT NULL ,
+    owner_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    redirect_uris text[] NOT NULL DEFAULT '{}' ,
+    scopes text[] NOT NULL
+);
+-- 用户同意授权后签发的一次性授权码
+CREATE TABLE IF NOT EXISTS oauth_codes(
+    hash bytea PRIMARY KEY ,
+    client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    redirect_uri text NOT NULL ,
+    scopes text[] NOT NULL ,
+    code_challenge text NOT NULL ,
+    expiry timestamp(0) with time zone NOT NULL
+);
+-- 签发给第三方应用的访问Token 只能使用被授予的scope
+CREATE TABLE IF NOT EXISTS oauth_tokens(
+    hash bytea PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    scopes text[] NOT NULL ,
+    expiry timestamp(0) with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS oauth_tokens_user_id_idx ON oauth_tokens(user_id);
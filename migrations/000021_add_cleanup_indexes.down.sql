@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_unactivated_created_at_idx;
+DROP INDEX IF EXISTS tokens_expiry_idx;
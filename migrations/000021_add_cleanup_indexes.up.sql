@@ -0,0 +1,3 @@
+-- 后台任务按过期时间清理Token 按注册时间清理未激活的账号
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens(expiry);
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users(created_at) WHERE activated = false;
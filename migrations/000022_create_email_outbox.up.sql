@@ -0,0 +1,15 @@
+-- 待发送的邮件 与触发发送的数据在同一个事务中写入 由后台的发送任务投递
+CREATE TABLE IF NOT EXISTS email_outbox(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    recipient text NOT NULL ,
+    subject text NOT NULL ,
+    plain_body text NOT NULL ,
+    html_body text NOT NULL ,
+    status text NOT NULL DEFAULT 'pending' ,
+    attempts integer NOT NULL DEFAULT 0 ,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    last_error text NOT NULL DEFAULT '' ,
+    sent_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS email_outbox_pending_idx ON email_outbox(next_attempt_at) WHERE status = 'pending';
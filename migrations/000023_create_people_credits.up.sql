@@ -0,0 +1,21 @@
+-- 演职人员
+CREATE TABLE IF NOT EXISTS people(
+    id bigserial PRIMARY KEY ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    name text NOT NULL ,
+    birth_year integer ,
+    biography text NOT NULL DEFAULT '' ,
+    version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS people_name_idx ON people USING GIN(to_tsvector('simple',name));
+-- 电影的演职人员 同一个人可以在同一部电影中担任多个职务
+CREATE TABLE IF NOT EXISTS movie_credits(
+    id bigserial PRIMARY KEY ,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+    person_id bigint NOT NULL REFERENCES people ON DELETE CASCADE ,
+    role text NOT NULL CHECK ( role IN ('director','writer','actor','composer') ) ,
+    character text NOT NULL DEFAULT '' ,
+    billing_order integer NOT NULL DEFAULT 0 ,
+    UNIQUE (movie_id,person_id,role,character)
+);
+CREATE INDEX IF NOT EXISTS movie_credits_person_id_idx ON movie_credits(person_id);
@@ -0,0 +1,3 @@
+ALTER TABLE movies DROP COLUMN IF EXISTS votes;
+ALTER TABLE movies DROP COLUMN IF EXISTS rating;
+DROP TABLE IF EXISTS reviews;
@@ -0,0 +1,16 @@
+-- 用户对电影的评分与评论 每个用户对每部电影只能有一条
+CREATE TABLE IF NOT EXISTS reviews(
+    id bigserial PRIMARY KEY ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+    score integer NOT NULL CHECK ( score BETWEEN 1 AND 10 ) ,
+    body text NOT NULL DEFAULT '' ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    version integer NOT NULL DEFAULT 1 ,
+    UNIQUE (user_id,movie_id)
+);
+CREATE INDEX IF NOT EXISTS reviews_movie_id_idx ON reviews(movie_id);
+-- 冗余存储的平均评分与评分人数 与评论在同一个事务中更新
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating numeric(4,2) NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS votes integer NOT NULL DEFAULT 0;
@@ -0,0 +1,16 @@
+-- 用户想看的电影
+CREATE TABLE IF NOT EXISTS watchlist(
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    PRIMARY KEY (user_id,movie_id)
+);
+-- 用户的观看记录 同一部电影可以多次观看
+CREATE TABLE IF NOT EXISTS watch_history(
+    id bigserial PRIMARY KEY ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+    watched_at timestamp(0) with time zone NOT NULL ,
+    rating integer CHECK ( rating BETWEEN 1 AND 10 )
+);
+CREATE INDEX IF NOT EXISTS watch_history_user_id_movie_id_idx ON watch_history(user_id,movie_id);
@@ -0,0 +1,25 @@
+-- 用户整理的电影片单 通过随机生成的slug分享
+-- private只有创建者可见 unlisted持有链接即可查看 public会出现在公开的片单列表中
+CREATE TABLE IF NOT EXISTS lists(
+    id bigserial PRIMARY KEY ,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+    name text NOT NULL ,
+    description text NOT NULL DEFAULT '' ,
+    visibility text NOT NULL DEFAULT 'private' CHECK ( visibility IN ('private','unlisted','public') ) ,
+    slug text NOT NULL UNIQUE ,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS lists_user_id_idx ON lists(user_id);
+CREATE INDEX IF NOT EXISTS lists_public_name_idx ON lists USING GIN (to_tsvector('simple',name)) WHERE visibility = 'public';
+-- 片单中的电影 position从1开始连续编号
+-- position的唯一约束延迟到事务提交时检查 调整顺序时可以在同一个事务中交换位置
+CREATE TABLE IF NOT EXISTS list_items(
+    list_id bigint NOT NULL REFERENCES lists ON DELETE CASCADE ,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+    position integer NOT NULL CHECK ( position > 0 ) ,
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+    PRIMARY KEY (list_id,movie_id),
+    CONSTRAINT list_items_position_key UNIQUE (list_id,position) DEFERRABLE INITIALLY DEFERRED
+);
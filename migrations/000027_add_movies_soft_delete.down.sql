@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'movie:trash';
+-- 删除列之前彻底删除已经在回收站中的电影 否则它们会重新出现在列表中
+DELETE FROM movies WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS movies_deleted_at_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,12 @@
+-- 删除电影时只记录删除的时间 保留期结束后由后台任务彻底删除
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON movies(deleted_at) WHERE deleted_at IS NOT NULL;
+-- 查看与恢复已删除电影所需的权限 授予内置的admin角色
+INSERT INTO permissions(code)
+SELECT 'movie:trash'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'movie:trash');
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE roles.name = 'admin' AND permissions.code = 'movie:trash'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,18 @@
+-- 发表、修改与删除评论所需的权限 只有读权限的API秘钥与OAuth2令牌不能代替用户发表评论
+INSERT INTO permissions(code)
+SELECT 'review:write'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'review:write');
+-- 授予所有内置角色
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE roles.name IN ('viewer','editor','admin') AND permissions.code = 'review:write'
+ON CONFLICT DO NOTHING;
+-- 已经拥有读权限的用户在此之前可以发表评论 授予新权限以保持原来的行为
+INSERT INTO users_permissions
+SELECT users_permissions.user_id,review_write.id
+FROM users_permissions
+JOIN permissions AS movie_read ON movie_read.id = users_permissions.permission_id
+CROSS JOIN permissions AS review_write
+WHERE movie_read.code = 'movie:read' AND review_write.code = 'review:write'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS auth_failures_last_failure_at_idx;
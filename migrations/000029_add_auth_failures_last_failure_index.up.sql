@@ -0,0 +1,2 @@
+-- 后台任务按最后一次失败的时间清理失败记录
+CREATE INDEX IF NOT EXISTS auth_failures_last_failure_at_idx ON auth_failures(last_failure_at);
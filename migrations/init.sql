@@ -59,4 +59,285 @@ CREATE TABLE IF NOT EXISTS users_permissions(
 INSERT INTO permissions(code)
 VALUES
     ('movie:read'),
-    ('movie:write');
\ No newline at end of file
+    ('movie:write');
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used bool NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens(family);
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial;
+ALTER TABLE tokens ADD CONSTRAINT tokens_id_key UNIQUE (id);
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS token_denylist(
+                                             hash bytea PRIMARY KEY ,
+                                             expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys(
+                                       id bigserial PRIMARY KEY ,
+                                       user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                       name text NOT NULL ,
+                                       prefix text NOT NULL ,
+                                       hash bytea UNIQUE NOT NULL ,
+                                       permissions text[] NOT NULL ,
+                                       created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                       last_used_at timestamp(0) with time zone ,
+                                       expiry timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys(user_id);
+
+CREATE TABLE IF NOT EXISTS user_totp(
+                                        user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE ,
+                                        secret bytea NOT NULL ,
+                                        confirmed bool NOT NULL DEFAULT false ,
+                                        last_used_step bigint NOT NULL DEFAULT 0 ,
+                                        created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS user_recovery_codes(
+                                                  id bigserial PRIMARY KEY ,
+                                                  user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                                  hash bytea NOT NULL ,
+                                                  used_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_id_idx ON user_recovery_codes(user_id);
+
+INSERT INTO permissions(code)
+VALUES
+    ('permissions:admin');
+CREATE TABLE IF NOT EXISTS permissions_audit(
+                                                id bigserial PRIMARY KEY ,
+                                                actor_id bigint REFERENCES users ON DELETE SET NULL ,
+                                                user_id bigint REFERENCES users ON DELETE SET NULL ,
+                                                permission text NOT NULL ,
+                                                action text NOT NULL CHECK ( action IN ('grant','revoke') ) ,
+                                                created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS permissions_audit_user_id_idx ON permissions_audit(user_id);
+
+CREATE TABLE IF NOT EXISTS roles(
+                                    id bigserial PRIMARY KEY ,
+                                    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                    name text UNIQUE NOT NULL ,
+                                    description text NOT NULL DEFAULT '' ,
+                                    builtin bool NOT NULL DEFAULT false ,
+                                    version integer NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS roles_permissions(
+                                                role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE ,
+                                                permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE ,
+                                                PRIMARY KEY (role_id,permission_id)
+);
+CREATE TABLE IF NOT EXISTS user_roles(
+                                         user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                         role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE ,
+                                         PRIMARY KEY (user_id,role_id)
+);
+INSERT INTO roles(name,description,builtin)
+VALUES
+    ('viewer','Read access to the movie catalogue',true),
+    ('editor','Read and write access to the movie catalogue',true),
+    ('admin','Full access including permission management',true);
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movie:read')
+   OR (roles.name = 'editor' AND permissions.code IN ('movie:read','movie:write'))
+   OR roles.name = 'admin';
+
+CREATE TABLE IF NOT EXISTS auth_failures(
+                                            kind text NOT NULL CHECK ( kind IN ('account','ip') ) ,
+                                            subject text NOT NULL ,
+                                            failures integer NOT NULL DEFAULT 0 ,
+                                            lock_count integer NOT NULL DEFAULT 0 ,
+                                            locked_until timestamp(0) with time zone ,
+                                            last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                            PRIMARY KEY (kind,subject)
+);
+
+CREATE TABLE IF NOT EXISTS email_changes(
+                                            user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE ,
+                                            new_email citext NOT NULL ,
+                                            created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT '';
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS users_deletion_scheduled_at_idx ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS invitations(
+                                          id bigserial PRIMARY KEY ,
+                                          created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                          hash bytea UNIQUE NOT NULL ,
+                                          email citext NOT NULL ,
+                                          invited_by bigint REFERENCES users ON DELETE SET NULL ,
+                                          role_id bigint REFERENCES roles ON DELETE SET NULL ,
+                                          permissions text[] NOT NULL DEFAULT '{}' ,
+                                          expiry timestamp(0) with time zone NOT NULL ,
+                                          accepted_at timestamp(0) with time zone ,
+                                          user_id bigint REFERENCES users ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities(
+                                              id bigserial PRIMARY KEY ,
+                                              created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                              user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                              provider text NOT NULL ,
+                                              subject text NOT NULL ,
+                                              email text NOT NULL DEFAULT '' ,
+                                              UNIQUE (provider,subject)
+);
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities(user_id);
+CREATE TABLE IF NOT EXISTS oidc_states(
+                                          hash bytea PRIMARY KEY ,
+                                          provider text NOT NULL ,
+                                          code_verifier text NOT NULL ,
+                                          nonce text NOT NULL ,
+                                          expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_clients(
+                                            id bigserial PRIMARY KEY ,
+                                            created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                            client_id text UNIQUE NOT NULL ,
+                                            secret_hash bytea ,
+                                            name text NOT NULL ,
+                                            owner_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                            redirect_uris text[] NOT NULL DEFAULT '{}' ,
+                                            scopes text[] NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth_codes(
+                                          hash bytea PRIMARY KEY ,
+                                          client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ,
+                                          user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                          redirect_uri text NOT NULL ,
+                                          scopes text[] NOT NULL ,
+                                          code_challenge text NOT NULL ,
+                                          expiry timestamp(0) with time zone NOT NULL
+);
+CREATE TABLE IF NOT EXISTS oauth_tokens(
+                                           hash bytea PRIMARY KEY ,
+                                           created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                           client_id text NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE ,
+                                           user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                           scopes text[] NOT NULL ,
+                                           expiry timestamp(0) with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS oauth_tokens_user_id_idx ON oauth_tokens(user_id);
+
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens(expiry);
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users(created_at) WHERE activated = false;
+
+CREATE TABLE IF NOT EXISTS email_outbox(
+                                           id bigserial PRIMARY KEY ,
+                                           created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                           recipient text NOT NULL ,
+                                           subject text NOT NULL ,
+                                           plain_body text NOT NULL ,
+                                           html_body text NOT NULL ,
+                                           status text NOT NULL DEFAULT 'pending' ,
+                                           attempts integer NOT NULL DEFAULT 0 ,
+                                           next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                           last_error text NOT NULL DEFAULT '' ,
+                                           sent_at timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS email_outbox_pending_idx ON email_outbox(next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS people(
+                                     id bigserial PRIMARY KEY ,
+                                     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                     name text NOT NULL ,
+                                     birth_year integer ,
+                                     biography text NOT NULL DEFAULT '' ,
+                                     version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS people_name_idx ON people USING GIN(to_tsvector('simple',name));
+CREATE TABLE IF NOT EXISTS movie_credits(
+                                            id bigserial PRIMARY KEY ,
+                                            movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+                                            person_id bigint NOT NULL REFERENCES people ON DELETE CASCADE ,
+                                            role text NOT NULL CHECK ( role IN ('director','writer','actor','composer') ) ,
+                                            character text NOT NULL DEFAULT '' ,
+                                            billing_order integer NOT NULL DEFAULT 0 ,
+                                            UNIQUE (movie_id,person_id,role,character)
+);
+CREATE INDEX IF NOT EXISTS movie_credits_person_id_idx ON movie_credits(person_id);
+
+CREATE TABLE IF NOT EXISTS reviews(
+                                      id bigserial PRIMARY KEY ,
+                                      user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                      movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+                                      score integer NOT NULL CHECK ( score BETWEEN 1 AND 10 ) ,
+                                      body text NOT NULL DEFAULT '' ,
+                                      created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                      updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                      version integer NOT NULL DEFAULT 1 ,
+                                      UNIQUE (user_id,movie_id)
+);
+CREATE INDEX IF NOT EXISTS reviews_movie_id_idx ON reviews(movie_id);
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS rating numeric(4,2) NOT NULL DEFAULT 0;
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS votes integer NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS watchlist(
+                                        user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                        movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+                                        added_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                        PRIMARY KEY (user_id,movie_id)
+);
+CREATE TABLE IF NOT EXISTS watch_history(
+                                            id bigserial PRIMARY KEY ,
+                                            user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                            movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+                                            watched_at timestamp(0) with time zone NOT NULL ,
+                                            rating integer CHECK ( rating BETWEEN 1 AND 10 )
+);
+CREATE INDEX IF NOT EXISTS watch_history_user_id_movie_id_idx ON watch_history(user_id,movie_id);
+
+CREATE TABLE IF NOT EXISTS lists(
+                                    id bigserial PRIMARY KEY ,
+                                    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE ,
+                                    name text NOT NULL ,
+                                    description text NOT NULL DEFAULT '' ,
+                                    visibility text NOT NULL DEFAULT 'private' CHECK ( visibility IN ('private','unlisted','public') ) ,
+                                    slug text NOT NULL UNIQUE ,
+                                    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                    version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS lists_user_id_idx ON lists(user_id);
+CREATE INDEX IF NOT EXISTS lists_public_name_idx ON lists USING GIN (to_tsvector('simple',name)) WHERE visibility = 'public';
+CREATE TABLE IF NOT EXISTS list_items(
+                                         list_id bigint NOT NULL REFERENCES lists ON DELETE CASCADE ,
+                                         movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE ,
+                                         position integer NOT NULL CHECK ( position > 0 ) ,
+                                         added_at timestamp(0) with time zone NOT NULL DEFAULT NOW() ,
+                                         PRIMARY KEY (list_id,movie_id),
+                                         CONSTRAINT list_items_position_key UNIQUE (list_id,position) DEFERRABLE INITIALLY DEFERRED
+);
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS movies_deleted_at_idx ON movies(deleted_at) WHERE deleted_at IS NOT NULL;
+INSERT INTO permissions(code)
+SELECT 'movie:trash'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'movie:trash');
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE roles.name = 'admin' AND permissions.code = 'movie:trash'
+ON CONFLICT DO NOTHING;
+
+INSERT INTO permissions(code)
+SELECT 'review:write'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'review:write');
+INSERT INTO roles_permissions
+SELECT roles.id,permissions.id
+FROM roles,permissions
+WHERE roles.name IN ('viewer','editor','admin') AND permissions.code = 'review:write'
+ON CONFLICT DO NOTHING;
+
+CREATE INDEX IF NOT EXISTS auth_failures_last_failure_at_idx ON auth_failures(last_failure_at);